@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"kepatrick/llm-playground/internal/config"
 	"kepatrick/llm-playground/internal/domain/repository"
+	"kepatrick/llm-playground/internal/domain/service"
 	httpAdapter "kepatrick/llm-playground/internal/gateway/http"
 
 	"kepatrick/llm-playground/internal/infra/database"
@@ -11,24 +13,40 @@ import (
 	"kepatrick/llm-playground/internal/infra/redis"
 
 	"kepatrick/llm-playground/internal/usecase"
+	"kepatrick/llm-playground/pkg/cassette"
+	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// defaults of options.json streamBuffer
+const (
+	defaultStreamBufferSize = 2000
+	defaultStreamBufferTTL  = 10 * time.Minute
 )
 
 func main() {
-	cfg := config.LoadLlmConfig()
 	// Infra init
-	httpClient := &http.Client{}
+	httpClient := getHttpClient(config.LoadOption())
+
+	var redisClient *goredis.Client
+	if config.LoadOption().Redis {
+		redisClient = redis.InitRedisClient(config.LoadRedis())
+	}
 
 	logRepo := getLogRepo(config.LoadOption())
-	sessRepo := getSessionRepo(config.LoadOption())
+	sessRepo := getSessionRepo(config.LoadOption(), redisClient)
+	streamRepo := getStreamRepo(config.LoadOption(), redisClient)
 
 	// init llm
-	llmSvc := llm.NewOpenAILLMService(cfg.ApiKey, cfg.ApiUrl, cfg.Model, httpClient, config.LoadToolDef())
+	llmSvc := getLLMService(config.LoadOption(), httpClient, getRateLimiter(config.LoadOption(), redisClient))
 
 	// Usecase init
-	genUsecase := usecase.NewGenerateUsecase(llmSvc, sessRepo, logRepo)
+	genUsecase := usecase.NewGenerateUsecase(llmSvc, sessRepo, logRepo, local.NewFileImageRepo("./local/images/"), streamRepo)
 
 	// HTTP Server
 	r := gin.Default()
@@ -37,11 +55,38 @@ func main() {
 	r.Run(":8080")
 }
 
-func getSessionRepo(cfg config.Option) repository.SessionRepository {
+// getHttpClient returns the client of the llm apis, recording or replaying a
+// cassette when configured
+func getHttpClient(cfg config.Option) *http.Client {
+	mode, path := cfg.Cassette.Mode, cfg.Cassette.Path
+	if env := os.Getenv("LLM_CASSETTE_MODE"); env != "" {
+		mode = env
+	}
+	if env := os.Getenv("LLM_CASSETTE_PATH"); env != "" {
+		path = env
+	}
+	if mode == "" {
+		return &http.Client{}
+	}
+
+	// The configured query parameters may carry credentials, none is recorded
+	var redact []string
+	for _, api := range config.LoadApis() {
+		for name := range api.Query {
+			redact = append(redact, name)
+		}
+	}
+	transport, err := cassette.New(cassette.Mode(mode), path, nil, redact...)
+	if err != nil {
+		log.Fatalf("fail to init cassette, err: %v", err)
+	}
+	fmt.Printf("llm calls %s cassette %s\n", mode, path)
+	return &http.Client{Transport: transport}
+}
+
+func getSessionRepo(cfg config.Option, redisClient *goredis.Client) repository.SessionRepository {
 	var sessionRepo repository.SessionRepository
 	if cfg.Redis {
-		// init redis
-		redisClient := redis.InitRedisClient(config.LoadRedis())
 		sessionRepo = redis.NewRedisSessionRepo(redisClient)
 	} else {
 		sessionRepo = local.NewFileSessionRepo("./local/session/")
@@ -49,6 +94,22 @@ func getSessionRepo(cfg config.Option) repository.SessionRepository {
 	return sessionRepo
 }
 
+func getStreamRepo(cfg config.Option, redisClient *goredis.Client) repository.StreamRepository {
+	size := cfg.StreamBuffer.Size
+	if size <= 0 {
+		size = defaultStreamBufferSize
+	}
+	ttl := time.Duration(cfg.StreamBuffer.TtlSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = defaultStreamBufferTTL
+	}
+
+	if cfg.Redis {
+		return redis.NewRedisStreamRepo(redisClient, size, ttl)
+	}
+	return local.NewMemoryStreamRepo(size, ttl)
+}
+
 func getLogRepo(cfg config.Option) repository.LogRepository {
 	var logRepo repository.LogRepository
 	//init database
@@ -62,3 +123,33 @@ func getLogRepo(cfg config.Option) repository.LogRepository {
 	}
 	return logRepo
 }
+
+func getRateLimiter(cfg config.Option, redisClient *goredis.Client) service.RateLimiter {
+	if cfg.Redis {
+		return redis.NewRedisRateLimiter(redisClient)
+	}
+	return local.NewMemoryRateLimiter()
+}
+
+func getLLMService(cfg config.Option, httpClient *http.Client, limiter service.RateLimiter) service.LLMService {
+	apis := config.LoadApis()
+	tools := config.LoadToolDef()
+
+	// every entry can be picked per request, selectApi and fallbackApis form the default chain
+	providers := map[string]service.LLMService{}
+	for name, apiCfg := range apis {
+		svc := llm.NewLLMService(name, apiCfg, httpClient, tools, limiter)
+		providers[name] = llm.NewCircuitBreakerLLMService(name, svc, apiCfg.CircuitBreaker)
+	}
+	for _, name := range cfg.ApiChain() {
+		if _, ok := providers[name]; !ok {
+			log.Fatalf("api %s not found in api config", name)
+		}
+	}
+	if name := cfg.Summarize.Api; name != "" {
+		if _, ok := providers[name]; !ok {
+			log.Fatalf("summarize api %s not found in api config", name)
+		}
+	}
+	return llm.NewFallbackLLMService(providers, cfg.ApiChain())
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"kepatrick/llm-playground/pkg/mockllm"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// mockllm serves a scripted OpenAI compatible api, point the apiUrl of an
+// api.json entry at http://localhost:8081/v1/chat/completions
+func main() {
+	addr := flag.String("addr", ":8081", "listen address")
+	scenarios := flag.String("scenarios", "./configs/mockllm/scenarios.json", "scenario file")
+	flag.Parse()
+
+	script, err := mockllm.LoadScript(*scenarios)
+	if err != nil {
+		log.Fatalf("fail to load scenarios, err: %v", err)
+	}
+
+	mock := mockllm.NewServer(script)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/chat/completions") {
+			http.NotFound(w, r)
+			return
+		}
+		mock.ServeHTTP(w, r)
+	})
+
+	fmt.Printf("mockllm listening on %s with %d scenarios\n", *addr, len(script.Scenarios))
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
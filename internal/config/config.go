@@ -1,8 +1,12 @@
 package config
 
 import (
+	"fmt"
 	"kepatrick/llm-playground/internal/config/reader"
 	"log"
+	"os"
+	"regexp"
+	"slices"
 )
 
 type DbConfig struct {
@@ -16,16 +20,159 @@ type DbConfig struct {
 type Apis map[string]ApiConfig
 
 type ApiConfig struct {
-	Model  string `json:"model"`
-	ApiKey string `json:"apiKey"`
-	ApiUrl string `json:"apiUrl"`
+	Provider string `json:"provider"` // openai (default), azure, anthropic, ollama, gemini
+	Model    string `json:"model"`
+	ApiKey   string `json:"apiKey"`
+	ApiUrl   string `json:"apiUrl"`
+
+	// AuthScheme is how OpenAI compatible and azure apis send the key: bearer
+	// (Authorization: Bearer, the openai default), api-key (the api-key header,
+	// the azure default) or none
+	AuthScheme string            `json:"authScheme"`
+	Headers    map[string]string `json:"headers"` // extra request headers, for any provider
+	Query      map[string]string `json:"query"`   // extra query parameters, for any provider
+
+	// Deployment and ApiVersion build the azure url from the resource endpoint
+	// in ApiUrl, the deployment defaults to Model
+	Deployment string `json:"deployment"`
+	ApiVersion string `json:"apiVersion"`
+
+	// IncludeUsage sends stream_options.include_usage, for OpenAI compatible apis
+	// that only report usage on request
+	IncludeUsage bool        `json:"includeUsage"`
+	Retry        RetryConfig `json:"retry"`
+
+	// ContextWindow is the model's context length in tokens, older turns are
+	// left out of calls that would exceed it, 0 sends the whole history
+	ContextWindow int `json:"contextWindow"`
+
+	CircuitBreaker CircuitBreakerConfig `json:"circuitBreaker"`
+	RateLimit      RateLimitConfig      `json:"rateLimit"`
+}
+
+// RateLimitConfig caps the requests and tokens per minute sent to an api,
+// shared by every instance through Redis when options.redis is on
+type RateLimitConfig struct {
+	Rpm       int  `json:"rpm"`       // requests per minute, 0 is unlimited
+	Tpm       int  `json:"tpm"`       // prompt and completion tokens per minute, 0 is unlimited
+	Reject    bool `json:"reject"`    // refuse calls over the limit instead of waiting
+	MaxWaitMs int  `json:"maxWaitMs"` // calls that would wait longer are refused, 0 waits as long as needed
+}
+
+// RetryConfig is the retry policy for 429, 5xx and network errors of an api
+type RetryConfig struct {
+	MaxAttempts int     `json:"maxAttempts"` // total attempts, 0 or 1 disables retry
+	BaseDelayMs int     `json:"baseDelayMs"` // first backoff, doubled per attempt
+	MaxDelayMs  int     `json:"maxDelayMs"`  // backoff cap, a longer Retry-After is not retried
+	Jitter      float64 `json:"jitter"`      // random extra delay as a fraction of the backoff
+}
+
+// CircuitBreakerConfig opens the circuit of an api whose recent calls fail or
+// answer slowly too often, calls are then refused until a trial call succeeds.
+// Without rates the circuit never opens but the health is still tracked.
+type CircuitBreakerConfig struct {
+	Window        int     `json:"window"`        // recent calls the rates are taken over, default 20
+	MinCalls      int     `json:"minCalls"`      // calls in the window before the circuit may open, default 5
+	ErrorRate     float64 `json:"errorRate"`     // share of failed calls that opens the circuit, 0 disables
+	SlowCallMs    int     `json:"slowCallMs"`    // time to first output above which a call is slow
+	SlowCallRate  float64 `json:"slowCallRate"`  // share of slow calls that opens the circuit, 0 disables
+	OpenSeconds   int     `json:"openSeconds"`   // how long the circuit stays open, default 30
+	HalfOpenCalls int     `json:"halfOpenCalls"` // trial calls that must succeed to close it, default 1
+}
+
+// ModelPrice is the price of a model in USD per million tokens
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+	Cached float64 `json:"cached"` // prompt tokens read from the cache, 0 charges them as input
+	// CacheWrite prices prompt tokens written to the cache, 0 charges them
+	// cacheWriteMarkup times the input price
+	CacheWrite float64 `json:"cacheWrite"`
+}
+
+// cacheWriteMarkup is what a cache write costs over a plain input token when
+// the model has no cacheWrite price, the 5 minute cache of Anthropic
+const cacheWriteMarkup = 1.25
+
+// Pricing maps the model of api.json entries to its price
+type Pricing map[string]ModelPrice
+
+// Cost returns the price of a turn of the model, false if the model has no price
+func (p Pricing) Cost(model string, reqToken, cachedToken, cacheWriteToken, resToken int) (float64, bool) {
+	price, ok := p[model]
+	if !ok {
+		return 0, false
+	}
+	cached := price.Cached
+	if cached == 0 {
+		cached = price.Input
+	}
+	cacheWrite := price.CacheWrite
+	if cacheWrite == 0 {
+		cacheWrite = price.Input * cacheWriteMarkup
+	}
+	cost := float64(reqToken-cachedToken-cacheWriteToken)*price.Input + float64(cachedToken)*cached +
+		float64(cacheWriteToken)*cacheWrite + float64(resToken)*price.Output
+	return cost / 1e6, true
 }
 
 type Option struct {
-	SelectApi        string `json:"selectApi"`
-	SysPrompt        string `json:"sysPrompt"`
-	RelationDatabase bool   `json:"relationDatabase"`
-	Redis            bool   `json:"redis"`
+	SelectApi        string   `json:"selectApi"`
+	FallbackApis     []string `json:"fallbackApis"`
+	SysPrompt        string   `json:"sysPrompt"`
+	RelationDatabase bool     `json:"relationDatabase"`
+	Redis            bool     `json:"redis"`
+	DefaultParams    Params   `json:"defaultParams"`
+
+	// StructuredOutputRetries is how often a structured answer that fails its
+	// schema is sent back to the model with the validation errors
+	StructuredOutputRetries int `json:"structuredOutputRetries"`
+
+	StreamBuffer StreamBuffer `json:"streamBuffer"`
+	AutoContinue AutoContinue `json:"autoContinue"`
+	Summarize    Summarize    `json:"summarize"`
+	Cassette     Cassette     `json:"cassette"`
+}
+
+// Cassette records the upstream llm traffic to a file or replays it offline,
+// the env vars LLM_CASSETTE_MODE and LLM_CASSETTE_PATH take precedence
+type Cassette struct {
+	Mode string `json:"mode"` // record or replay, empty calls the apis normally
+	Path string `json:"path"`
+}
+
+// AutoContinue lets an answer cut at max tokens be continued by further calls
+// appending to the same assistant message
+type AutoContinue struct {
+	Enabled          bool `json:"enabled"`
+	MaxContinuations int  `json:"maxContinuations"` // continuation calls per turn
+}
+
+// StreamBuffer sizes the per session buffer of stream events that lets a
+// client resume a turn, unset fields use the defaults of main
+type StreamBuffer struct {
+	Size       int `json:"size"`       // events kept per turn
+	TtlSeconds int `json:"ttlSeconds"` // how long a finished turn stays resumable
+}
+
+// Summarize compacts long sessions: once the history sent upstream exceeds
+// ThresholdTokens, all but the latest KeepTurns turns are replaced by a summary
+type Summarize struct {
+	Enabled         bool   `json:"enabled"`
+	ThresholdTokens int    `json:"thresholdTokens"`
+	KeepTurns       int    `json:"keepTurns"`
+	Api             string `json:"api"` // api.json entry writing the summary, empty uses the default chain
+}
+
+// Params are default sampling parameters, unset fields are left to the provider
+type Params struct {
+	Temperature      *float64 `json:"temperature"`
+	TopP             *float64 `json:"topP"`
+	MaxTokens        *int     `json:"maxTokens"`
+	Stop             []string `json:"stop"`
+	Seed             *int     `json:"seed"`
+	PresencePenalty  *float64 `json:"presencePenalty"`
+	FrequencyPenalty *float64 `json:"frequencyPenalty"`
 }
 
 type Tool struct {
@@ -57,9 +204,15 @@ type Redis struct {
 var (
 	Options Option
 	Tools   []Tool
+
+	schemaName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
 )
 
 func init() {
+	// Tests run from their package directory, without the configs of the repo root
+	if _, err := os.Stat("./configs/options.json"); os.IsNotExist(err) {
+		return
+	}
 	Options = LoadOption()
 }
 
@@ -72,12 +225,37 @@ func LoadDbConfig() DbConfig {
 }
 
 func LoadLlmConfig() ApiConfig {
+	return LoadApis()[Options.SelectApi]
+}
+
+func LoadApis() Apis {
 	apis, err := reader.LoadJsonConfig[Apis]("./configs/api.json")
 	if err != nil {
 		log.Fatalf("fail to load api config, err: %v", err)
 	}
+	return apis
+}
 
-	return apis[Options.SelectApi]
+// ApiChain returns the selected api followed by the fallback apis, in the order they are tried
+func (o Option) ApiChain() []string {
+	chain := []string{o.SelectApi}
+	for _, name := range o.FallbackApis {
+		if !slices.Contains(chain, name) {
+			chain = append(chain, name)
+		}
+	}
+	return chain
+}
+
+// LoadPricing reads configs/pricing.json, without the file every turn costs 0
+func LoadPricing() Pricing {
+	pricing, err := reader.LoadJsonConfig[Pricing]("./configs/pricing.json")
+	if os.IsNotExist(err) {
+		return Pricing{}
+	} else if err != nil {
+		log.Fatalf("fail to load pricing, err: %v", err)
+	}
+	return pricing
 }
 
 func LoadOption() Option {
@@ -97,6 +275,14 @@ func LoadToolDef() []Tool {
 	return tools
 }
 
+// LoadSchema reads the named JSON schema from ./configs/schemas/<name>.json
+func LoadSchema(name string) (map[string]interface{}, error) {
+	if !schemaName.MatchString(name) {
+		return nil, fmt.Errorf("invalid schema name %q", name)
+	}
+	return reader.LoadJsonConfig[map[string]interface{}]("./configs/schemas/" + name + ".json")
+}
+
 func LoadRedis() Redis {
 	redis, err := reader.LoadJsonConfig[Redis]("./configs/redis.json")
 	if err != nil {
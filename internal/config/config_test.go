@@ -0,0 +1,34 @@
+package config
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPricingCost(t *testing.T) {
+	pricing := Pricing{
+		"plain":  {Input: 1, Output: 2},
+		"priced": {Input: 1, Output: 2, Cached: 0.1, CacheWrite: 2},
+	}
+	tests := []struct {
+		name                 string
+		model                string
+		req, cached, written int
+		res                  int
+		want                 float64
+		wantOk               bool
+	}{
+		{"unknown model", "other", 1e6, 0, 0, 0, 0, false},
+		{"cache reads default to input", "plain", 1e6, 5e5, 0, 1e6, 1 + 2, true},
+		{"cache writes default to a markup on input", "plain", 1e6, 0, 4e5, 0, 0.6 + 0.4*1.25, true},
+		{"cache prices", "priced", 1e6, 5e5, 4e5, 0, 0.1 + 0.05 + 0.8, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := pricing.Cost(tt.model, tt.req, tt.cached, tt.written, tt.res)
+			if ok != tt.wantOk || math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Cost = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package entity
+
+// CostTotal sums the turns logged for a session or a day. Tokens and cost come
+// from the usage the apis reported; turns whose tokens were estimated locally
+// are totalled apart, as their counts are approximations of unknown accuracy.
+type CostTotal struct {
+	SessionID       string  `json:"sessionId,omitempty"`
+	Day             string  `json:"day,omitempty"` // 2006-01-02 in local time
+	Turns           int     `json:"turns"`         // every turn, estimated ones included
+	ReqToken        int     `json:"reqToken"`
+	ResToken        int     `json:"resToken"`
+	CachedToken     int     `json:"cachedToken"`
+	CacheWriteToken int     `json:"cacheWriteToken"`
+	Cost            float64 `json:"cost"` // USD
+
+	EstimatedTurns    int     `json:"estimatedTurns"`
+	EstimatedReqToken int     `json:"estimatedReqToken"`
+	EstimatedResToken int     `json:"estimatedResToken"`
+	EstimatedCost     float64 `json:"estimatedCost"` // USD
+}
+
+// Add counts a logged turn into the total
+func (t *CostTotal) Add(rec Record) {
+	t.Turns++
+	if rec.TokenEstimated {
+		t.EstimatedTurns++
+		t.EstimatedReqToken += rec.ReqToken
+		t.EstimatedResToken += rec.ResToken
+		t.EstimatedCost += rec.Cost
+		return
+	}
+	t.ReqToken += rec.ReqToken
+	t.ResToken += rec.ResToken
+	t.CachedToken += rec.CachedToken
+	t.CacheWriteToken += rec.CacheWriteToken
+	t.Cost += rec.Cost
+}
@@ -0,0 +1,39 @@
+package entity
+
+import "testing"
+
+func TestCostTotalAdd(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []Record
+		want    CostTotal
+	}{
+		{
+			name:    "reported usage",
+			records: []Record{{ReqToken: 100, ResToken: 20, CachedToken: 50, CacheWriteToken: 10, Cost: 0.5}},
+			want:    CostTotal{Turns: 1, ReqToken: 100, ResToken: 20, CachedToken: 50, CacheWriteToken: 10, Cost: 0.5},
+		},
+		{
+			name: "estimated turns are totalled apart",
+			records: []Record{
+				{ReqToken: 100, ResToken: 20, Cost: 0.5},
+				{ReqToken: 300, ResToken: 40, Cost: 1, TokenEstimated: true},
+			},
+			want: CostTotal{
+				Turns: 2, ReqToken: 100, ResToken: 20, Cost: 0.5,
+				EstimatedTurns: 1, EstimatedReqToken: 300, EstimatedResToken: 40, EstimatedCost: 1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var total CostTotal
+			for _, rec := range tt.records {
+				total.Add(rec)
+			}
+			if total != tt.want {
+				t.Errorf("total = %+v, want %+v", total, tt.want)
+			}
+		})
+	}
+}
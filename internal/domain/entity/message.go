@@ -6,4 +6,33 @@ type Message struct {
 	ToolCallID string                   `json:"tool_call_id"`
 	ToolCalls  []map[string]interface{} `json:"tool_calls"`
 	Timestamp  string
+	// Interrupted marks an answer cut off by a cancelled generation
+	Interrupted bool `json:"interrupted,omitempty"`
+	// ReasoningContent is the reasoning streamed before the answer, kept for
+	// display but never sent back upstream
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+	// Parts holds the text and images of a multimodal message, Content keeps
+	// its text for providers and views that only handle plain text
+	Parts []ContentPart `json:"parts,omitempty"`
+	// Summary marks a system message that condenses the first SummaryOf
+	// messages of the session, it is sent upstream in their place
+	Summary   bool `json:"summary,omitempty"`
+	SummaryOf int  `json:"summary_of,omitempty"`
+}
+
+// Content part types
+const (
+	PartText     = "text"
+	PartImageURL = "image_url" // image fetched by the provider from URL
+	PartImage    = "image"     // base64 image, inline in Data or stored at Path
+)
+
+// ContentPart is one piece of a multimodal message
+type ContentPart struct {
+	Type      string `json:"type"`
+	Text      string `json:"text,omitempty"`
+	URL       string `json:"url,omitempty"`
+	MediaType string `json:"media_type,omitempty"` // e.g. image/png
+	Data      string `json:"data,omitempty"`       // base64, not persisted for stored images
+	Path      string `json:"path,omitempty"`       // local copy of an uploaded image
 }
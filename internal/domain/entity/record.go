@@ -0,0 +1,45 @@
+package entity
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Record is the log of one generate turn
+type Record struct {
+	SessionID  string
+	Provider   string // api.json entry that served the turn
+	ReqMessage string
+	ResMessage string
+	ReqToken   int
+	ResToken   int
+	// ReasoningToken is the part of ResToken spent on reasoning
+	ReasoningToken int
+	// TokenEstimated marks token counts estimated locally because the api reported no usage
+	TokenEstimated bool
+	Interrupted    bool // the generation was cancelled and ResMessage is partial
+	// FinishReason is why the answer ended: stop, length or content_filter
+	FinishReason string
+	// Continuations counts the calls issued to continue an answer cut at max tokens
+	Continuations int
+	// CachedToken is the part of ReqToken read from the prompt cache
+	CachedToken int
+	// CacheWriteToken is the part of ReqToken written to the prompt cache
+	CacheWriteToken int
+	// Cost is the price of the turn in USD, 0 if the model has no price
+	Cost float64
+	// ArenaID is set on the turns of an arena, one per compared api
+	ArenaID     string
+	SendTime    time.Time
+	ReceiveTime time.Time
+}
+
+// NewRecordID returns a unique id for a log record. The send second leads so
+// ids still sort by time, the random suffix keeps the turns logged within the
+// same second, such as those of an arena, apart.
+func NewRecordID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,8 @@
+package entity
+
+// StreamEvent is a buffered event of a generation stream
+type StreamEvent struct {
+	ID   string // increasing within a turn, sent as the SSE id
+	Type string
+	Data string // JSON payload
+}
@@ -0,0 +1,18 @@
+package entity
+
+import "time"
+
+// Outcomes of an arena vote besides the name of the preferred api
+const (
+	VoteTie     = "tie"
+	VoteBothBad = "both_bad"
+)
+
+// Vote is the preference recorded for the answers of an arena turn
+type Vote struct {
+	ArenaID   string
+	SessionID string
+	Apis      []string // the compared api.json entries
+	Winner    string   // one of Apis, VoteTie or VoteBothBad
+	VoteTime  time.Time
+}
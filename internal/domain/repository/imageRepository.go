@@ -0,0 +1,13 @@
+package repository
+
+import (
+	"context"
+	"kepatrick/llm-playground/internal/domain/entity"
+)
+
+type ImageRepository interface {
+	// Save stores an uploaded image and returns the part referring to it
+	Save(ctx context.Context, sessionID, mediaType string, data []byte) (entity.ContentPart, error)
+	// Load reads back the image stored at path
+	Load(ctx context.Context, path string) ([]byte, error)
+}
@@ -1,7 +1,16 @@
 package repository
 
-import "time"
+import (
+	"kepatrick/llm-playground/internal/domain/entity"
+	"time"
+)
 
 type LogRepository interface {
-	Insert(sessionId, reqMsg, resMsg string, reqToken, resToken int, sendTime, receiveTime time.Time) error
+	Insert(record entity.Record) error
+	// SessionCost totals the logged turns of a session
+	SessionCost(sessionID string) (entity.CostTotal, error)
+	// DailyCosts totals the turns sent in [from, to) by local day, oldest first
+	DailyCosts(from, to time.Time) ([]entity.CostTotal, error)
+	// InsertVote stores the preference vote of an arena turn
+	InsertVote(vote entity.Vote) error
 }
@@ -0,0 +1,23 @@
+package repository
+
+import (
+	"context"
+	"kepatrick/llm-playground/internal/domain/entity"
+)
+
+// StreamRepository buffers the stream events of each session's latest turn,
+// so a client that lost its connection can replay and follow them
+type StreamRepository interface {
+	// Open starts a new turn of the session, dropping the events of the previous one
+	Open(ctx context.Context, sessionID string) error
+	// Append buffers an event of the running turn and returns it with its id
+	Append(ctx context.Context, sessionID string, event entity.StreamEvent) (entity.StreamEvent, error)
+	// Close marks the turn as finished
+	Close(ctx context.Context, sessionID string) error
+	// Read returns the events after lastID, an empty lastID reads from the start.
+	// It blocks until there are new events or the turn is finished, in which
+	// case closed is true and no events are left.
+	Read(ctx context.Context, sessionID, lastID string) (events []entity.StreamEvent, closed bool, err error)
+	// Exists reports whether the session has a buffered turn
+	Exists(ctx context.Context, sessionID string) bool
+}
@@ -2,23 +2,64 @@ package service
 
 import (
 	"context"
+	"errors"
 	"kepatrick/llm-playground/internal/domain/entity"
 )
 
+// ErrUnsupportedInput is returned for a request the api cannot take, such as
+// an image url sent to an api that only accepts inline images
+var ErrUnsupportedInput = errors.New("input not supported by the api")
+
 type LLMResult struct {
-	LlmRes        string
-	IsToolCall    bool
-	ToolCallDepth int
-	ReqToken      int
-	ResToken      int
-	Messages      []entity.Message
+	LlmRes          string
+	IsToolCall      bool
+	ToolCallDepth   int
+	ReqToken        int
+	ResToken        int
+	Messages        []entity.Message
+	Provider        string // api.json entry that served the call
+	TokenEstimated  bool   // some call reported no usage and its tokens were estimated locally
+	ReasoningToken  int    // part of ResToken spent on reasoning, a provider reports only its own call
+	CachedToken     int    // part of ReqToken read from the prompt cache, a provider reports only its own call
+	CacheWriteToken int    // part of ReqToken written to the prompt cache, a provider reports only its own call
+	FinishReason    string // why the last call stopped, one of the Finish constants, empty if unknown
+}
+
+// Finish reasons of a call, normalized across providers
+const (
+	FinishStop          = "stop"
+	FinishLength        = "length"         // the output hit max tokens
+	FinishContentFilter = "content_filter" // the output was cut by a safety filter
+	FinishToolCalls     = "tool_calls"
+)
+
+// GenerateParams are the per request model selection and sampling parameters,
+// nil fields are left to the provider default
+type GenerateParams struct {
+	Api              string // api.json entry, empty means selectApi and its fallbacks
+	Temperature      *float64
+	TopP             *float64
+	MaxTokens        *int
+	Stop             []string
+	Seed             *int
+	PresencePenalty  *float64
+	FrequencyPenalty *float64
+	ResponseFormat   *ResponseFormat // nil means free text
+	NoTools          bool            // offer no tools, for internal calls such as summaries
+}
+
+// ResponseFormat asks for a JSON answer, optionally constrained by a schema
+type ResponseFormat struct {
+	Type   string                 // json_object or json_schema
+	Name   string                 // schema name, sent to providers that require one
+	Schema map[string]interface{} // JSON schema of json_schema
 }
 
 type LLMService interface {
-	StreamingCall(ctx context.Context, messages []entity.Message, writer StreamWriter, lastRslt LLMResult) (LLMResult, error)
+	StreamingCall(ctx context.Context, messages []entity.Message, params GenerateParams, writer StreamWriter, lastRslt LLMResult) (LLMResult, error)
 }
 
+// StreamWriter delivers the typed events of a generation to the client
 type StreamWriter interface {
-	Write(data string) error
-	Done() error
+	Send(event StreamEvent) error
 }
@@ -0,0 +1,28 @@
+package service
+
+import "time"
+
+// Circuit states of a provider
+const (
+	CircuitClosed   = "closed"    // calls go through
+	CircuitOpen     = "open"      // calls are refused until RetryAt
+	CircuitHalfOpen = "half_open" // trial calls decide whether to close again
+)
+
+// ProviderHealth is the circuit state and the recent calls of an api.json entry
+type ProviderHealth struct {
+	Name         string     `json:"name"`
+	State        string     `json:"state"`
+	Calls        int        `json:"calls"` // calls in the window
+	Failures     int        `json:"failures"`
+	SlowCalls    int        `json:"slowCalls"`
+	ErrorRate    float64    `json:"errorRate"`
+	AvgLatencyMs int64      `json:"avgLatencyMs"` // average time to first output
+	LastError    string     `json:"lastError,omitempty"`
+	RetryAt      *time.Time `json:"retryAt,omitempty"` // when an open circuit lets a trial call through
+}
+
+// HealthReporter is implemented by llm services that track the health of their providers
+type HealthReporter interface {
+	ProvidersHealth() []ProviderHealth
+}
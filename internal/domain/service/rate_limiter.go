@@ -0,0 +1,20 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrRateLimited is returned for calls refused by the rate limit of an api
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimiter keeps a token bucket per key, filled by perMinute tokens a
+// minute up to perMinute
+type RateLimiter interface {
+	// Take removes n tokens, a negative n gives tokens back. The bucket may go
+	// into debt; the returned wait is how long until it is out of debt again.
+	// If that is longer than maxWait the tokens are not taken and ok is false,
+	// a negative maxWait accepts any wait.
+	Take(ctx context.Context, key string, n, perMinute int, maxWait time.Duration) (wait time.Duration, ok bool, err error)
+}
@@ -0,0 +1,102 @@
+package service
+
+// Event types of the generation stream
+const (
+	EventToken         = "token"           // piece of the answer
+	EventReasoning     = "reasoning"       // piece of the reasoning of reasoning models
+	EventToolCallStart = "tool_call_start" // the model started a tool call
+	EventToolCallArgs  = "tool_call_args"  // fragment of the arguments of a tool call
+	EventToolResult    = "tool_result"     // output of an executed tool
+	EventUsage         = "usage"           // token usage of the turn
+	EventStatus        = "status"          // progress notice outside the answer, e.g. retries
+	EventError         = "error"           // the generation failed, the stream ends
+	EventDone          = "done"            // the turn is complete
+	EventArena         = "arena"           // an arena turn started, the events of each api are tagged with its model
+)
+
+// StreamEvent is one event of the generation stream, Data is sent JSON encoded
+type StreamEvent struct {
+	ID   string // assigned once the event is buffered for replay
+	Type string
+	Data interface{}
+}
+
+type TextPayload struct {
+	Text string `json:"text"`
+}
+
+type ToolCallPayload struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+	Name  string `json:"name,omitempty"`
+}
+
+type ToolArgsPayload struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+	Delta string `json:"delta"`
+}
+
+type ToolResultPayload struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Result string `json:"result"`
+}
+
+type UsagePayload struct {
+	Provider       string `json:"provider"`
+	ReqToken       int    `json:"reqToken"`
+	ResToken       int    `json:"resToken"`
+	ReasoningToken int    `json:"reasoningToken"`
+	Estimated      bool   `json:"estimated"`
+	FinishReason   string `json:"finishReason,omitempty"`
+}
+
+type MessagePayload struct {
+	Message string `json:"message"`
+}
+
+type ArenaPayload struct {
+	ArenaID string   `json:"arenaId"`
+	Models  []string `json:"models"`
+}
+
+func TokenEvent(text string) StreamEvent {
+	return StreamEvent{Type: EventToken, Data: TextPayload{text}}
+}
+
+func ReasoningEvent(text string) StreamEvent {
+	return StreamEvent{Type: EventReasoning, Data: TextPayload{text}}
+}
+
+func ToolCallStartEvent(id string, index int, name string) StreamEvent {
+	return StreamEvent{Type: EventToolCallStart, Data: ToolCallPayload{id, index, name}}
+}
+
+func ToolCallArgsEvent(id string, index int, delta string) StreamEvent {
+	return StreamEvent{Type: EventToolCallArgs, Data: ToolArgsPayload{id, index, delta}}
+}
+
+func ToolResultEvent(id, name, result string) StreamEvent {
+	return StreamEvent{Type: EventToolResult, Data: ToolResultPayload{id, name, result}}
+}
+
+func UsageEvent(rslt LLMResult) StreamEvent {
+	return StreamEvent{Type: EventUsage, Data: UsagePayload{rslt.Provider, rslt.ReqToken, rslt.ResToken, rslt.ReasoningToken, rslt.TokenEstimated, rslt.FinishReason}}
+}
+
+func StatusEvent(msg string) StreamEvent {
+	return StreamEvent{Type: EventStatus, Data: MessagePayload{msg}}
+}
+
+func ErrorEvent(err error) StreamEvent {
+	return StreamEvent{Type: EventError, Data: MessagePayload{err.Error()}}
+}
+
+func ArenaEvent(arenaID string, models []string) StreamEvent {
+	return StreamEvent{Type: EventArena, Data: ArenaPayload{arenaID, models}}
+}
+
+func DoneEvent() StreamEvent {
+	return StreamEvent{Type: EventDone, Data: struct{}{}}
+}
@@ -1,6 +1,110 @@
 package http
 
+import (
+	"encoding/base64"
+	"fmt"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"strings"
+)
+
+// GenerateRequest is sent as JSON, or as multipart/form-data with the image
+// files in the "images" field
 type GenerateRequest struct {
-	SessionID string `json:"sessionId" binding:"required"`
-	Prompt    string `json:"prompt" binding:"required"`
+	SessionID string `json:"sessionId" form:"sessionId" binding:"required"`
+	Prompt    string `json:"prompt" form:"prompt" binding:"required"`
+
+	// Optional, unset fields fall back to options.json defaultParams
+	Api              string   `json:"api" form:"api"`
+	Temperature      *float64 `json:"temperature" form:"temperature" binding:"omitempty,min=0,max=2"`
+	TopP             *float64 `json:"topP" form:"topP" binding:"omitempty,gt=0,max=1"`
+	MaxTokens        *int     `json:"maxTokens" form:"maxTokens" binding:"omitempty,min=1"`
+	Stop             []string `json:"stop" form:"stop" binding:"omitempty,max=4,dive,required"`
+	Seed             *int     `json:"seed" form:"seed"`
+	PresencePenalty  *float64 `json:"presencePenalty" form:"presencePenalty" binding:"omitempty,min=-2,max=2"`
+	FrequencyPenalty *float64 `json:"frequencyPenalty" form:"frequencyPenalty" binding:"omitempty,min=-2,max=2"`
+
+	ResponseFormat *ResponseFormat `json:"responseFormat" form:"-"`
+
+	// Images of a JSON request, by URL or inline base64
+	Images []ImageInput `json:"images" form:"-" binding:"omitempty,max=8,dive"`
+}
+
+// ArenaRequest sends the prompt to every api of Apis side by side, the api
+// field of GenerateRequest is not used
+type ArenaRequest struct {
+	GenerateRequest
+	Apis []string `json:"apis" form:"apis" binding:"required,min=2,max=4,unique,dive,required"`
+}
+
+// VoteRequest names the api with the preferred answer, or tie or both_bad
+type VoteRequest struct {
+	Winner string `json:"winner" binding:"required"`
+}
+
+// ResponseFormat requests a JSON answer. json_schema takes either an inline
+// schema or the name of a file in configs/schemas.
+type ResponseFormat struct {
+	Type       string                 `json:"type" binding:"required,oneof=json_object json_schema"`
+	Schema     map[string]interface{} `json:"schema"`
+	SchemaName string                 `json:"schemaName"`
+}
+
+// ImageInput is an image given by url, or as base64 data (a data: URL is accepted too)
+type ImageInput struct {
+	Url       string `json:"url" binding:"required_without=Data"`
+	Data      string `json:"data" binding:"required_without=Url"`
+	MediaType string `json:"mediaType"`
+}
+
+// Params converts the optional fields into generate parameters
+func (r GenerateRequest) Params() service.GenerateParams {
+	return service.GenerateParams{
+		Api:              r.Api,
+		Temperature:      r.Temperature,
+		TopP:             r.TopP,
+		MaxTokens:        r.MaxTokens,
+		Stop:             r.Stop,
+		Seed:             r.Seed,
+		PresencePenalty:  r.PresencePenalty,
+		FrequencyPenalty: r.FrequencyPenalty,
+		ResponseFormat:   r.ResponseFormat.format(),
+	}
+}
+
+func (f *ResponseFormat) format() *service.ResponseFormat {
+	if f == nil {
+		return nil
+	}
+	return &service.ResponseFormat{
+		Type:   f.Type,
+		Name:   f.SchemaName,
+		Schema: f.Schema,
+	}
+}
+
+// decode returns the media type and bytes of an inline image
+func (i ImageInput) decode() (string, []byte, error) {
+	mediaType, data := i.MediaType, i.Data
+	if rest, ok := strings.CutPrefix(data, "data:"); ok {
+		header, payload, found := strings.Cut(rest, ",")
+		if !found || !strings.HasSuffix(header, ";base64") {
+			return "", nil, fmt.Errorf("image data URL must be base64 encoded")
+		}
+		mediaType, data = strings.TrimSuffix(header, ";base64"), payload
+	}
+
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid base64 image: %v", err)
+	}
+	if mediaType == "" {
+		return "", nil, fmt.Errorf("mediaType is required for base64 images")
+	}
+	return mediaType, b, nil
+}
+
+// urlPart returns the part of an image given by url
+func (i ImageInput) urlPart() entity.ContentPart {
+	return entity.ContentPart{Type: entity.PartImageURL, URL: i.Url}
 }
@@ -1,9 +1,16 @@
 package http
 
 import (
+	"errors"
+	"fmt"
 	"html/template"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/service"
 	usecase "kepatrick/llm-playground/internal/usecase"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -26,17 +33,211 @@ func RegisterRoutes(r *gin.Engine, u *usecase.GenerateUsecase) {
 		c.Redirect(http.StatusMovedPermanently, "/chat")
 	})
 
+	// Apis selectable per request
+	r.GET("/apis", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"apis":    u.ApiNames(),
+			"default": config.Options.SelectApi,
+		})
+	})
+
+	// Circuit state and recent calls of every api
+	r.GET("/providers/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"providers": u.ProvidersHealth()})
+	})
+
 	r.POST("/generate", func(c *gin.Context) {
+		// JSON, or multipart/form-data when images are uploaded
 		var req GenerateRequest
-		if err := c.ShouldBindJSON(&req); err != nil {
+		bind := c.ShouldBindJSON
+		if strings.HasPrefix(c.ContentType(), "multipart/") {
+			bind = c.ShouldBind
+		}
+		if err := bind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		params, err := u.ResolveParams(req.Params())
+		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		
+		images, err := collectImages(c, u, req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
 		// stream
 		w := NewGinStreamWriter(c)
-		if err := u.RunStream(c.Request.Context(), req.SessionID, req.Prompt, w); err != nil {
+		if err := u.RunStream(c.Request.Context(), req.SessionID, req.Prompt, images, params, w); err != nil {
+			streamError(c, w, errorStatus(err, http.StatusInternalServerError), err)
+		}
+	})
+
+	// Answer with several apis side by side, the events of each are tagged with its model
+	r.POST("/arena", func(c *gin.Context) {
+		var req ArenaRequest
+		bind := c.ShouldBindJSON
+		if strings.HasPrefix(c.ContentType(), "multipart/") {
+			bind = c.ShouldBind
+		}
+		if err := bind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		for _, api := range req.Apis {
+			if !slices.Contains(u.ApiNames(), api) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("api %s not found in api config", api)})
+				return
+			}
+		}
+		req.Api = ""
+		params, err := u.ResolveParams(req.Params())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		images, err := collectImages(c, u, req.GenerateRequest)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		w := NewGinStreamWriter(c)
+		if err := u.RunArena(c.Request.Context(), req.SessionID, req.Prompt, images, req.Apis, params, w); err != nil {
+			streamError(c, w, errorStatus(err, http.StatusInternalServerError), err)
+		}
+	})
+
+	// Record the preferred answer of an arena turn
+	r.POST("/arena/:arenaId/vote", func(c *gin.Context) {
+		var req VoteRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		err := u.Vote(c.Param("arenaId"), req.Winner)
+		switch {
+		case errors.Is(err, usecase.ErrArenaNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, usecase.ErrInvalidVote):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case err != nil:
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusOK, gin.H{"voted": true})
 		}
 	})
+
+	// Replay the session's latest turn after Last-Event-ID, then follow it live
+	r.GET("/generate/:sessionId/stream", func(c *gin.Context) {
+		lastID := c.GetHeader("Last-Event-ID")
+		if lastID == "" {
+			lastID = c.Query("lastEventId")
+		}
+
+		w := NewGinStreamWriter(c)
+		err := u.Resume(c.Request.Context(), c.Param("sessionId"), lastID, w)
+		if errors.Is(err, usecase.ErrStreamNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else if err != nil && c.Request.Context().Err() == nil {
+			streamError(c, w, http.StatusBadRequest, err)
+		}
+	})
+
+	// Full session history for export, summarized messages included
+	r.GET("/sessions/:sessionId/messages", func(c *gin.Context) {
+		msgs, err := u.History(c.Request.Context(), c.Param("sessionId"))
+		if errors.Is(err, usecase.ErrSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"messages": msgs})
+	})
+
+	// Cost and tokens of the turns of a session
+	r.GET("/sessions/:sessionId/cost", func(c *gin.Context) {
+		total, err := u.SessionCost(c.Param("sessionId"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, total)
+	})
+
+	// Cost and tokens per day, from and to are inclusive dates defaulting to the last 30 days
+	r.GET("/costs/daily", func(c *gin.Context) {
+		to, err := parseDay(c.Query("to"), time.Now())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		from, err := parseDay(c.Query("from"), to.AddDate(0, 0, -29))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if from.After(to) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from is after to"})
+			return
+		}
+		days, err := u.DailyCosts(from, to)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		total, estimated := 0.0, 0.0
+		for _, d := range days {
+			total += d.Cost
+			estimated += d.EstimatedCost
+		}
+		c.JSON(http.StatusOK, gin.H{"days": days, "total": total, "estimatedTotal": estimated})
+	})
+
+	// Cancel the in-flight generation of a session
+	r.POST("/generate/:sessionId/cancel", func(c *gin.Context) {
+		if !u.Cancel(c.Param("sessionId")) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no generation running for this session"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"cancelled": true})
+	})
+}
+
+// streamError answers err with status while nothing was streamed yet, once the
+// stream started it can only end with an error and a done event
+func streamError(c *gin.Context, w *GinStreamWriter, status int, err error) {
+	if w.Started() {
+		w.Send(service.ErrorEvent(err))
+		w.Send(service.DoneEvent())
+		return
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+// errorStatus maps an error of the llm service to its status, def for the rest
+func errorStatus(err error, def int) int {
+	switch {
+	case errors.Is(err, service.ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, service.ErrUnsupportedInput):
+		return http.StatusBadRequest
+	}
+	return def
+}
+
+// parseDay parses a YYYY-MM-DD query value in local time, empty gives def
+func parseDay(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	day, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err != nil {
+		return day, fmt.Errorf("invalid date %q, want YYYY-MM-DD", value)
+	}
+	return day, nil
 }
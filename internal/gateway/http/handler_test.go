@@ -0,0 +1,67 @@
+package http
+
+import (
+	"errors"
+	"kepatrick/llm-playground/internal/domain/service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStreamError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name        string
+		started     bool
+		wantStatus  int
+		wantType    string
+		wantInBody  []string
+		wantMissing string
+	}{
+		{
+			name:       "before the first event",
+			wantStatus: http.StatusTooManyRequests,
+			wantType:   "application/json",
+			wantInBody: []string{`{"error":"boom"}`},
+		},
+		{
+			name:        "after the first event",
+			started:     true,
+			wantStatus:  http.StatusOK,
+			wantType:    "text/event-stream",
+			wantInBody:  []string{"event: token\n", "event: error\ndata: {\"message\":\"boom\"}\n\n", "event: done\n"},
+			wantMissing: `{"error"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			w := NewGinStreamWriter(c)
+			if tt.started {
+				w.Send(service.TokenEvent("Hi"))
+			}
+
+			streamError(c, w, http.StatusTooManyRequests, errors.New("boom"))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.wantType)
+			}
+			body := rec.Body.String()
+			for _, s := range tt.wantInBody {
+				if !strings.Contains(body, s) {
+					t.Errorf("body %q misses %q", body, s)
+				}
+			}
+			if tt.wantMissing != "" && strings.Contains(body, tt.wantMissing) {
+				t.Errorf("body %q has %q", body, tt.wantMissing)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"kepatrick/llm-playground/internal/domain/entity"
+	usecase "kepatrick/llm-playground/internal/usecase"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxImageSize is the largest accepted image, in bytes
+const maxImageSize = 10 << 20
+
+// collectImages stores the uploaded and inline base64 images of the request
+// and returns the parts of the user message, url images are passed through
+func collectImages(c *gin.Context, u *usecase.GenerateUsecase, req GenerateRequest) ([]entity.ContentPart, error) {
+	var parts []entity.ContentPart
+
+	for _, img := range req.Images {
+		if img.Url != "" {
+			parts = append(parts, img.urlPart())
+			continue
+		}
+		mediaType, data, err := img.decode()
+		if err != nil {
+			return nil, err
+		}
+		part, err := saveImage(c, u, req.SessionID, mediaType, data)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+
+	if !strings.HasPrefix(c.ContentType(), "multipart/") {
+		return parts, nil
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, err
+	}
+	for _, fh := range form.File["images"] {
+		if fh.Size > maxImageSize {
+			return nil, fmt.Errorf("image %s exceeds %d bytes", fh.Filename, maxImageSize)
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		// Trust the content, not the declared type
+		part, err := saveImage(c, u, req.SessionID, http.DetectContentType(data), data)
+		if err != nil {
+			return nil, fmt.Errorf("image %s: %v", fh.Filename, err)
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+func saveImage(c *gin.Context, u *usecase.GenerateUsecase, sessionID, mediaType string, data []byte) (entity.ContentPart, error) {
+	if len(data) > maxImageSize {
+		return entity.ContentPart{}, fmt.Errorf("image exceeds %d bytes", maxImageSize)
+	}
+	return u.SaveImage(c.Request.Context(), sessionID, mediaType, data)
+}
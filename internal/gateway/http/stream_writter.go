@@ -1,28 +1,52 @@
 package http
 
 import (
+	"encoding/json"
+	"fmt"
+	"kepatrick/llm-playground/internal/domain/service"
+	"sync"
+
 	"github.com/gin-gonic/gin"
 )
 
-// GinStreamWriter implements StreamWriter for Gin
+// GinStreamWriter implements StreamWriter for Gin, every event is written as
+// "id: <id>\nevent: <type>\ndata: <json>". The SSE headers are set with the
+// first event, an error returned before it is still answered as plain JSON.
 type GinStreamWriter struct {
-	c *gin.Context
+	c       *gin.Context
+	mu      sync.Mutex
+	started bool
 }
 
 func NewGinStreamWriter(c *gin.Context) *GinStreamWriter {
-	c.Writer.Header().Set("Content-Type", "text/event-stream")
-	c.Writer.Header().Set("Cache-Control", "no-cache")
-	return &GinStreamWriter{c}
+	return &GinStreamWriter{c: c}
 }
 
-func (w *GinStreamWriter) Write(data string) error {
-	_, err := w.c.Writer.Write([]byte("data: " + data + "\n\n"))
+func (w *GinStreamWriter) Send(event service.StreamEvent) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.started {
+		w.started = true
+		w.c.Writer.Header().Set("Content-Type", "text/event-stream")
+		w.c.Writer.Header().Set("Cache-Control", "no-cache")
+	}
+	if event.ID != "" {
+		fmt.Fprintf(w.c.Writer, "id: %s\n", event.ID)
+	}
+	_, err = fmt.Fprintf(w.c.Writer, "event: %s\ndata: %s\n\n", event.Type, data)
 	w.c.Writer.Flush()
 	return err
 }
 
-func (w *GinStreamWriter) Done() error {
-	_, err := w.c.Writer.Write([]byte("data: [DONE]\n\n"))
-	w.c.Writer.Flush()
-	return err
+// Started reports whether an event was sent, from then on errors can only be
+// told as events
+func (w *GinStreamWriter) Started() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.started
 }
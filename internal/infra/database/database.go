@@ -3,6 +3,8 @@ package database
 import (
 	"fmt"
 	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"strings"
 	"time"
 
 	"gorm.io/driver/mysql"
@@ -33,23 +35,117 @@ func buildConnectionString(dbCnf config.DbConfig) string {
 }
 
 func NewLogRepository(db *gorm.DB) *LogRepository {
+	// Keep the table in step with Record as columns are added
+	if err := db.AutoMigrate(&Record{}, &Vote{}); err != nil {
+		panic("failed to migrate log tables: " + err.Error())
+	}
 	return &LogRepository{
 		db,
 	}
 }
 
-func (r *LogRepository) Insert(sessionId, reqMsg, resMsg string, reqToken, resToken int, sendTime, receiveTime time.Time) error {
-
-	r.dbClient.Create(&Record{
-		Id:          time.Now().Format("20060102150405"),
-		ChatId:      sessionId,
-		ReqMessage:  reqMsg,
-		ResMessage:  resMsg,
-		Prompt:      "",
-		ReqToken:    reqToken,
-		ResToken:    resToken,
-		SendTime:    sendTime,
-		ReceiveTime: receiveTime,
-	})
-	return nil
+func (r *LogRepository) Insert(record entity.Record) error {
+
+	return r.dbClient.Create(&Record{
+		Id:              entity.NewRecordID(),
+		ChatId:          record.SessionID,
+		Provider:        record.Provider,
+		ReqMessage:      record.ReqMessage,
+		ResMessage:      record.ResMessage,
+		Prompt:          "",
+		ReqToken:        record.ReqToken,
+		ResToken:        record.ResToken,
+		ReasoningToken:  record.ReasoningToken,
+		TokenEstimated:  record.TokenEstimated,
+		Interrupted:     record.Interrupted,
+		FinishReason:    record.FinishReason,
+		Continuations:   record.Continuations,
+		CachedToken:     record.CachedToken,
+		CacheWriteToken: record.CacheWriteToken,
+		Cost:            record.Cost,
+		ArenaId:         record.ArenaID,
+		SendTime:        record.SendTime,
+		ReceiveTime:     record.ReceiveTime,
+	}).Error
+}
+
+func (r *LogRepository) InsertVote(vote entity.Vote) error {
+	return r.dbClient.Create(&Vote{
+		ArenaId:  vote.ArenaID,
+		ChatId:   vote.SessionID,
+		Apis:     strings.Join(vote.Apis, ","),
+		Winner:   vote.Winner,
+		VoteTime: vote.VoteTime,
+	}).Error
+}
+
+// costRow is a SUM over records, Day is only selected by DailyCosts
+type costRow struct {
+	Day               time.Time
+	Turns             int
+	ReqToken          int
+	ResToken          int
+	CachedToken       int
+	CacheWriteToken   int
+	Cost              float64
+	EstimatedTurns    int
+	EstimatedReqToken int
+	EstimatedResToken int
+	EstimatedCost     float64
+}
+
+// costColumns sums reported usage and estimated usage apart, see entity.CostTotal
+const costColumns = "COUNT(*) AS turns, " +
+	"COALESCE(SUM(CASE WHEN token_estimated THEN 0 ELSE req_token END), 0) AS req_token, " +
+	"COALESCE(SUM(CASE WHEN token_estimated THEN 0 ELSE res_token END), 0) AS res_token, " +
+	"COALESCE(SUM(CASE WHEN token_estimated THEN 0 ELSE cached_token END), 0) AS cached_token, " +
+	"COALESCE(SUM(CASE WHEN token_estimated THEN 0 ELSE cache_write_token END), 0) AS cache_write_token, " +
+	"COALESCE(SUM(CASE WHEN token_estimated THEN 0 ELSE cost END), 0) AS cost, " +
+	"COALESCE(SUM(CASE WHEN token_estimated THEN 1 ELSE 0 END), 0) AS estimated_turns, " +
+	"COALESCE(SUM(CASE WHEN token_estimated THEN req_token ELSE 0 END), 0) AS estimated_req_token, " +
+	"COALESCE(SUM(CASE WHEN token_estimated THEN res_token ELSE 0 END), 0) AS estimated_res_token, " +
+	"COALESCE(SUM(CASE WHEN token_estimated THEN cost ELSE 0 END), 0) AS estimated_cost"
+
+// total converts the sums of a row
+func (row costRow) total() entity.CostTotal {
+	return entity.CostTotal{
+		Turns:             row.Turns,
+		ReqToken:          row.ReqToken,
+		ResToken:          row.ResToken,
+		CachedToken:       row.CachedToken,
+		CacheWriteToken:   row.CacheWriteToken,
+		Cost:              row.Cost,
+		EstimatedTurns:    row.EstimatedTurns,
+		EstimatedReqToken: row.EstimatedReqToken,
+		EstimatedResToken: row.EstimatedResToken,
+		EstimatedCost:     row.EstimatedCost,
+	}
+}
+
+func (r *LogRepository) SessionCost(sessionID string) (entity.CostTotal, error) {
+	var row costRow
+	err := r.dbClient.Model(&Record{}).Select(costColumns).Where("chat_id = ?", sessionID).Scan(&row).Error
+	total := row.total()
+	total.SessionID = sessionID
+	return total, err
+}
+
+func (r *LogRepository) DailyCosts(from, to time.Time) ([]entity.CostTotal, error) {
+	var rows []costRow
+	err := r.dbClient.Model(&Record{}).
+		Select("DATE(send_time) AS day, "+costColumns).
+		Where("send_time >= ? AND send_time < ?", from, to).
+		Group("DATE(send_time)").
+		Order("day").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	totals := make([]entity.CostTotal, 0, len(rows))
+	for _, row := range rows {
+		total := row.total()
+		total.Day = row.Day.Format(time.DateOnly)
+		totals = append(totals, total)
+	}
+	return totals, nil
 }
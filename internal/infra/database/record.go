@@ -3,13 +3,33 @@ package database
 import "time"
 
 type Record struct {
-	Id          string
-	ChatId      string
-	ReqMessage  string
-	ResMessage  string
-	Prompt      string
-	ReqToken    int
-	ResToken    int
-	SendTime    time.Time
-	ReceiveTime time.Time
+	Id              string
+	ChatId          string
+	Provider        string
+	ReqMessage      string
+	ResMessage      string
+	Prompt          string
+	ReqToken        int
+	ResToken        int
+	ReasoningToken  int
+	TokenEstimated  bool
+	Interrupted     bool
+	FinishReason    string
+	Continuations   int
+	CachedToken     int
+	CacheWriteToken int
+	Cost            float64
+	ArenaId         string
+	SendTime        time.Time
+	ReceiveTime     time.Time
+}
+
+// Vote is the preference vote of an arena turn
+type Vote struct {
+	Id       uint `gorm:"primaryKey"`
+	ArenaId  string
+	ChatId   string
+	Apis     string // comma separated
+	Winner   string
+	VoteTime time.Time
 }
@@ -0,0 +1,385 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// anthropicVersion is the Messages API version sent with every request
+const anthropicVersion = "2023-06-01"
+
+// anthropicMaxTokens is the default max_tokens value, which the Messages API requires
+const anthropicMaxTokens = 4096
+
+// anthropicFormatTool names the tool a response format is forced through, the
+// Messages API has no response_format: the input of its call is the answer
+const anthropicFormatTool = "json_response"
+
+// AnthropicLLMService handles interactions with the Anthropic Messages API
+type AnthropicLLMService struct {
+	apiKey string       // API key for authentication
+	apiUrl string       // API endpoint URL
+	model  string       // model
+	client *http.Client // HTTP client for making requests
+	tools  []config.Tool
+}
+
+// anthropicEvent is one event of the Messages API stream
+type anthropicEvent struct {
+	Type    string `json:"type"`
+	Index   int    `json:"index"`
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	ContentBlock struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"content_block"`
+	Delta struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// anthropicUsage is the usage object of message_start and message_delta events,
+// input_tokens leaves out the tokens read from or written to the prompt cache
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+}
+
+// NewAnthropicLLMService creates a new instance of AnthropicLLMService
+func NewAnthropicLLMService(key, url, model string, cli *http.Client, tools []config.Tool) *AnthropicLLMService {
+	return &AnthropicLLMService{key, url, model, cli, tools}
+}
+
+func (s *AnthropicLLMService) StreamingCall(ctx context.Context, messages []entity.Message, params service.GenerateParams, writer service.StreamWriter, lastRslt service.LLMResult) (service.LLMResult, error) {
+	var builder strings.Builder
+	var curReqToken int
+	var curResToken int
+	var cachedToken int
+	var cacheWriteToken int
+	var stopReason string
+
+	depth := lastRslt.ToolCallDepth + 1
+	reqTokens := lastRslt.ReqToken
+	resTokens := lastRslt.ResToken
+
+	// tool_use blocks in stream order, and by content block index for input deltas
+	functionCalls := []*FunctionCall{}
+	blockCalls := map[int]*FunctionCall{}
+	formatBlock := -1 // content block index of the format tool call
+
+	if depth > maxToolCallDepth {
+		return buildLLMRslt("tool calling out of limit", false, depth, reqTokens, resTokens, nil), errToolCallDepth
+	}
+
+	system, msgs := s.buildMessages(messages)
+
+	// Prepare request body with streaming enabled
+	body := map[string]interface{}{
+		"model":      s.model,
+		"max_tokens": anthropicMaxTokens,
+		"messages":   msgs,
+		"stream":     true,
+	}
+	if system != "" {
+		body["system"] = system
+	}
+	tools := offeredTools(s.tools, params)
+	reqTools := s.prepareReqTools(tools)
+	if format := anthropicFormatSchema(params.ResponseFormat); format != nil {
+		reqTools = append(reqTools, map[string]interface{}{
+			"name":         anthropicFormatTool,
+			"description":  "Give your final answer through this tool, its input is the answer.",
+			"input_schema": format,
+		})
+		// Other tools stay usable as long as the turn ends with the format tool
+		body["tool_choice"] = map[string]interface{}{"type": "tool", "name": anthropicFormatTool}
+		if len(tools) > 0 {
+			body["tool_choice"] = map[string]interface{}{"type": "any"}
+		}
+	}
+	if len(reqTools) > 0 {
+		body["tools"] = reqTools
+	}
+	// The Messages API has no seed or penalties
+	if params.Temperature != nil {
+		body["temperature"] = *params.Temperature
+	}
+	if params.TopP != nil {
+		body["top_p"] = *params.TopP
+	}
+	if params.MaxTokens != nil {
+		body["max_tokens"] = *params.MaxTokens
+	}
+	if len(params.Stop) > 0 {
+		body["stop_sequences"] = params.Stop
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), errors.Wrap(err, "marshal stream body")
+	}
+
+	// Create HTTP request
+	req, _ := http.NewRequestWithContext(ctx, "POST", s.apiUrl, bytes.NewBuffer(data))
+	req.Header.Set("x-api-key", s.apiKey)
+	req.Header.Set("anthropic-version", anthropicVersion)
+	req.Header.Set("Content-Type", "application/json")
+
+	// Execute request
+	res, err := s.client.Do(req)
+	if err != nil {
+		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), err
+	}
+	defer res.Body.Close()
+
+	// Check http status
+	if res.StatusCode != http.StatusOK {
+		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), newUpstreamError(res)
+	}
+
+	// Read response stream, the event type is repeated inside every data payload
+	rd := newSSEReader(res.Body)
+readStream:
+	for {
+		evt, err := rd.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), err
+		}
+
+		var event anthropicEvent
+		if err := json.Unmarshal([]byte(evt.Data), &event); err != nil {
+			return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), &StreamFormatError{Provider: ProviderAnthropic, Frame: evt.Data, Err: err}
+		}
+
+		switch event.Type {
+		case "message_start":
+			usage := event.Message.Usage
+			curReqToken = usage.InputTokens + usage.CacheReadInputTokens + usage.CacheCreationInputTokens
+			cachedToken = usage.CacheReadInputTokens
+			cacheWriteToken = usage.CacheCreationInputTokens
+		case "content_block_start":
+			if event.ContentBlock.Type == "tool_use" && event.ContentBlock.Name == anthropicFormatTool {
+				formatBlock = event.Index
+			} else if event.ContentBlock.Type == "tool_use" {
+				fc := &FunctionCall{Index: len(functionCalls), ID: event.ContentBlock.ID, Name: event.ContentBlock.Name}
+				functionCalls = append(functionCalls, fc)
+				blockCalls[event.Index] = fc
+				writer.Send(service.ToolCallStartEvent(fc.ID, fc.Index, fc.Name))
+			}
+		case "content_block_delta":
+			switch event.Delta.Type {
+			case "text_delta":
+				builder.WriteString(event.Delta.Text)
+				writer.Send(service.TokenEvent(event.Delta.Text))
+			case "input_json_delta":
+				if event.Index == formatBlock {
+					builder.WriteString(event.Delta.PartialJSON)
+					writer.Send(service.TokenEvent(event.Delta.PartialJSON))
+				} else if fc, ok := blockCalls[event.Index]; ok && event.Delta.PartialJSON != "" {
+					fc.Arguments.WriteString(event.Delta.PartialJSON)
+					writer.Send(service.ToolCallArgsEvent(fc.ID, fc.Index, event.Delta.PartialJSON))
+				}
+			}
+		case "message_delta":
+			curResToken = event.Usage.OutputTokens
+			if event.Delta.StopReason != "" {
+				stopReason = event.Delta.StopReason
+			}
+		case "error":
+			return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), fmt.Errorf("stream upstream error %s: %s", event.Error.Type, event.Error.Message)
+		case "message_stop":
+			break readStream
+		}
+	}
+	reqTokens += curReqToken
+	resTokens += curResToken
+
+	if len(functionCalls) > 0 {
+		messages = appendToolCallMessages(ctx, messages, builder.String(), "", tools, functionCalls, writer)
+		// return with toolcall
+		rslt := buildLLMRslt("", true, depth, reqTokens, resTokens, messages)
+		rslt.CachedToken = cachedToken
+		rslt.CacheWriteToken = cacheWriteToken
+		rslt.FinishReason = service.FinishToolCalls
+		return rslt, nil
+	}
+
+	if builder.Len() > 0 {
+		messages = append(messages, entity.Message{
+			Role:      "assistant",
+			Content:   builder.String(),
+			Timestamp: nowMilli(),
+		})
+	}
+
+	rslt := buildLLMRslt(builder.String(), false, depth, reqTokens, resTokens, messages)
+	rslt.CachedToken = cachedToken
+	rslt.CacheWriteToken = cacheWriteToken
+	rslt.FinishReason = anthropicFinishReason(stopReason)
+	if formatBlock >= 0 && stopReason == "tool_use" {
+		rslt.FinishReason = service.FinishStop
+	}
+	return rslt, nil
+}
+
+// anthropicFormatSchema returns the input schema of the format tool, nil
+// without a format. Tool inputs are objects, a schema of any other type is
+// left to the format instruction of the prompt and the validation of the answer.
+func anthropicFormatSchema(f *service.ResponseFormat) map[string]interface{} {
+	if f == nil {
+		return nil
+	}
+	if f.Type != "json_schema" {
+		return map[string]interface{}{"type": "object"}
+	}
+	if t, ok := f.Schema["type"]; ok && t != "object" {
+		return nil
+	}
+	return f.Schema
+}
+
+// anthropicFinishReason maps a Messages API stop_reason to a service finish reason
+func anthropicFinishReason(stopReason string) string {
+	switch stopReason {
+	case "end_turn", "stop_sequence":
+		return service.FinishStop
+	case "max_tokens":
+		return service.FinishLength
+	case "tool_use":
+		return service.FinishToolCalls
+	case "refusal":
+		return service.FinishContentFilter
+	}
+	return stopReason
+}
+
+// buildMessages converts the session history into the system prompt and the
+// Messages API message array. Tool results become tool_result blocks of a user
+// message, and consecutive messages of the same role are merged into one.
+func (s *AnthropicLLMService) buildMessages(raw []entity.Message) (string, []map[string]interface{}) {
+	var system []string
+	var msgs []map[string]interface{}
+	for _, m := range raw {
+		var role string
+		var blocks []map[string]interface{}
+
+		switch m.Role {
+		case "system":
+			system = append(system, m.Content)
+			continue
+		case "tool":
+			role = "user"
+			blocks = append(blocks, map[string]interface{}{
+				"type":        "tool_result",
+				"tool_use_id": m.ToolCallID,
+				"content":     m.Content,
+			})
+		default:
+			role = m.Role
+			if len(m.Parts) > 0 {
+				blocks = append(blocks, anthropicContentParts(m.Parts)...)
+			} else if m.Content != "" {
+				blocks = append(blocks, map[string]interface{}{
+					"type": "text",
+					"text": m.Content,
+				})
+			}
+			for _, tc := range m.ToolCalls {
+				blocks = append(blocks, anthropicToolUse(tc))
+			}
+		}
+
+		if len(blocks) == 0 {
+			continue
+		}
+		if n := len(msgs); n > 0 && msgs[n-1]["role"] == role {
+			msgs[n-1]["content"] = append(msgs[n-1]["content"].([]map[string]interface{}), blocks...)
+			continue
+		}
+		msgs = append(msgs, map[string]interface{}{
+			"role":    role,
+			"content": blocks,
+		})
+	}
+	return strings.Join(system, "\n\n"), msgs
+}
+
+// anthropicContentParts converts multimodal parts into Messages API content
+// blocks, images are sent as base64 or url sources
+func anthropicContentParts(parts []entity.ContentPart) []map[string]interface{} {
+	var blocks []map[string]interface{}
+	for _, p := range parts {
+		switch p.Type {
+		case entity.PartText:
+			blocks = append(blocks, map[string]interface{}{"type": "text", "text": p.Text})
+		case entity.PartImageURL:
+			blocks = append(blocks, map[string]interface{}{
+				"type":   "image",
+				"source": map[string]interface{}{"type": "url", "url": p.URL},
+			})
+		case entity.PartImage:
+			blocks = append(blocks, map[string]interface{}{
+				"type":   "image",
+				"source": map[string]interface{}{"type": "base64", "media_type": p.MediaType, "data": p.Data},
+			})
+		}
+	}
+	return blocks
+}
+
+// prepareReqTools converts tool definitions into Messages API tools
+func (s *AnthropicLLMService) prepareReqTools(tools []config.Tool) []map[string]interface{} {
+	results := make([]map[string]interface{}, 0, len(tools))
+	for _, t := range tools {
+		results = append(results, map[string]interface{}{
+			"name":         t.Function.Name,
+			"description":  t.Function.Description,
+			"input_schema": t.Function.Parameters,
+		})
+	}
+	return results
+}
+
+// anthropicToolUse converts a stored OpenAI style tool call into a tool_use block
+func anthropicToolUse(tc map[string]interface{}) map[string]interface{} {
+	id, _ := tc["id"].(string)
+	fn, _ := tc["function"].(map[string]interface{})
+	name, _ := fn["name"].(string)
+	args, _ := fn["arguments"].(string)
+
+	input := json.RawMessage("{}")
+	if args != "" && json.Valid([]byte(args)) {
+		input = json.RawMessage(args)
+	}
+	return map[string]interface{}{
+		"type":  "tool_use",
+		"id":    id,
+		"name":  name,
+		"input": input,
+	}
+}
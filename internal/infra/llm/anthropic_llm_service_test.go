@@ -0,0 +1,243 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// anthropicStream is a recorded Messages API stream: text, then two tool_use
+// blocks whose input deltas arrive interleaved
+const anthropicStream = `event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":20,"cache_read_input_tokens":100,"cache_creation_input_tokens":5,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: ping
+data: {"type":"ping"}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Let me "}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"check."}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":0}
+
+event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_a","name":"get_weather","input":{}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_b","name":"get_time","input":{}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"zone\":\"UTC\"}"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":1}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":2}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":42}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+func TestAnthropicStreamToolCalls(t *testing.T) {
+	srv, reqBody := replayServer(t, "text/event-stream", anthropicStream)
+	svc := NewAnthropicLLMService("key", srv.URL, "claude", http.DefaultClient, nil)
+	w := &eventRecorder{}
+
+	msgs := []entity.Message{{Role: "system", Content: "sys"}, {Role: "user", Content: "weather?"}}
+	rslt, err := svc.StreamingCall(context.Background(), msgs, service.GenerateParams{}, w, service.LLMResult{ReqToken: 7, ResToken: 3})
+	if err != nil {
+		t.Fatalf("StreamingCall: %v", err)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(*reqBody, &body); err != nil {
+		t.Fatalf("request body: %v", err)
+	}
+	if body["system"] != "sys" || body["stream"] != true {
+		t.Errorf("request body = %v, want the system prompt and stream", body)
+	}
+
+	if !rslt.IsToolCall || rslt.FinishReason != service.FinishToolCalls {
+		t.Errorf("IsToolCall = %v, FinishReason = %q, want a tool call", rslt.IsToolCall, rslt.FinishReason)
+	}
+	if rslt.ReqToken != 7+125 || rslt.ResToken != 3+42 || rslt.CachedToken != 100 || rslt.CacheWriteToken != 5 {
+		t.Errorf("tokens = %d/%d cached %d written %d, want 132/45 cached 100 written 5", rslt.ReqToken, rslt.ResToken, rslt.CachedToken, rslt.CacheWriteToken)
+	}
+
+	// assistant message with both calls, then one tool message per call
+	if len(rslt.Messages) != len(msgs)+3 {
+		t.Fatalf("got %d messages, want %d", len(rslt.Messages), len(msgs)+3)
+	}
+	assistant := rslt.Messages[len(msgs)]
+	if assistant.Content != "Let me check." {
+		t.Errorf("content = %q, want %q", assistant.Content, "Let me check.")
+	}
+	want := [][3]string{
+		{"toolu_a", "get_weather", `{"city":"Paris"}`},
+		{"toolu_b", "get_time", `{"zone":"UTC"}`},
+	}
+	if len(assistant.ToolCalls) != len(want) {
+		t.Fatalf("got %d tool calls, want %d", len(assistant.ToolCalls), len(want))
+	}
+	for i, tc := range assistant.ToolCalls {
+		id, name, args := toolCallOf(tc)
+		if [3]string{id, name, args} != want[i] {
+			t.Errorf("tool call %d = %v, want %v", i, [3]string{id, name, args}, want[i])
+		}
+		if tool := rslt.Messages[len(msgs)+1+i]; tool.Role != "tool" || tool.ToolCallID != want[i][0] {
+			t.Errorf("message %d = %s %q, want the tool result of %s", len(msgs)+1+i, tool.Role, tool.ToolCallID, want[i][0])
+		}
+	}
+
+	if n := w.count(service.EventToken); n != 2 {
+		t.Errorf("got %d token events, want 2", n)
+	}
+	if n := w.count(service.EventToolCallStart); n != 2 {
+		t.Errorf("got %d tool call start events, want 2", n)
+	}
+}
+
+func TestAnthropicStreamStopReason(t *testing.T) {
+	tests := []struct {
+		stopReason string
+		want       string
+	}{
+		{"end_turn", service.FinishStop},
+		{"stop_sequence", service.FinishStop},
+		{"max_tokens", service.FinishLength},
+		{"refusal", service.FinishContentFilter},
+		{"pause_turn", "pause_turn"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.stopReason, func(t *testing.T) {
+			stream := strings.Join([]string{
+				`data: {"type":"message_start","message":{"usage":{"input_tokens":5}}}`,
+				`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}`,
+				`data: {"type":"message_delta","delta":{"stop_reason":"` + tt.stopReason + `"},"usage":{"output_tokens":1}}`,
+				`data: {"type":"message_stop"}`,
+			}, "\n\n") + "\n\n"
+			srv, _ := replayServer(t, "text/event-stream", stream)
+			svc := NewAnthropicLLMService("key", srv.URL, "claude", http.DefaultClient, nil)
+
+			rslt, err := svc.StreamingCall(context.Background(), []entity.Message{{Role: "user", Content: "hi"}}, service.GenerateParams{}, &eventRecorder{}, service.LLMResult{})
+			if err != nil {
+				t.Fatalf("StreamingCall: %v", err)
+			}
+			if rslt.FinishReason != tt.want {
+				t.Errorf("FinishReason = %q, want %q", rslt.FinishReason, tt.want)
+			}
+			if rslt.LlmRes != "Hi" || rslt.IsToolCall {
+				t.Errorf("answer = %q tool call %v, want %q", rslt.LlmRes, rslt.IsToolCall, "Hi")
+			}
+		})
+	}
+}
+
+func TestAnthropicStreamError(t *testing.T) {
+	stream := `data: {"type":"message_start","message":{"usage":{"input_tokens":5}}}
+
+data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}
+
+`
+	srv, _ := replayServer(t, "text/event-stream", stream)
+	svc := NewAnthropicLLMService("key", srv.URL, "claude", http.DefaultClient, nil)
+
+	_, err := svc.StreamingCall(context.Background(), []entity.Message{{Role: "user", Content: "hi"}}, service.GenerateParams{}, &eventRecorder{}, service.LLMResult{})
+	if err == nil || !strings.Contains(err.Error(), "overloaded_error") {
+		t.Errorf("err = %v, want the upstream overloaded_error", err)
+	}
+}
+
+// anthropicFormatStream answers through the forced format tool
+const anthropicFormatStream = `event: message_start
+data: {"type":"message_start","message":{"usage":{"input_tokens":20,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_f","name":"json_response","input":{}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"sentiment\":"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"\"positive\"}"}}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":9}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+func TestAnthropicResponseFormat(t *testing.T) {
+	object := map[string]interface{}{"type": "object", "properties": map[string]interface{}{"sentiment": map[string]interface{}{"type": "string"}}}
+	tests := []struct {
+		name       string
+		format     *service.ResponseFormat
+		wantSchema interface{} // input_schema of the format tool, nil when no tool is forced
+	}{
+		{"json_object", &service.ResponseFormat{Type: "json_object"}, map[string]interface{}{"type": "object"}},
+		{"object schema", &service.ResponseFormat{Type: "json_schema", Schema: object}, object},
+		{"array schema is left to the prompt", &service.ResponseFormat{Type: "json_schema", Schema: map[string]interface{}{"type": "array"}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, reqBody := replayServer(t, "text/event-stream", anthropicFormatStream)
+			svc := NewAnthropicLLMService("key", srv.URL, "claude", http.DefaultClient, nil)
+			rslt, err := svc.StreamingCall(context.Background(), []entity.Message{{Role: "user", Content: "I love it"}}, service.GenerateParams{ResponseFormat: tt.format}, &eventRecorder{}, service.LLMResult{})
+			if err != nil {
+				t.Fatalf("StreamingCall: %v", err)
+			}
+
+			var body struct {
+				Tools []struct {
+					Name        string      `json:"name"`
+					InputSchema interface{} `json:"input_schema"`
+				} `json:"tools"`
+				ToolChoice map[string]interface{} `json:"tool_choice"`
+			}
+			if err := json.Unmarshal(*reqBody, &body); err != nil {
+				t.Fatalf("request body: %v", err)
+			}
+			if tt.wantSchema == nil {
+				if len(body.Tools) != 0 || body.ToolChoice != nil {
+					t.Errorf("tools = %+v, tool_choice = %v, want none", body.Tools, body.ToolChoice)
+				}
+				return
+			}
+			if len(body.Tools) != 1 || body.Tools[0].Name != anthropicFormatTool || !reflect.DeepEqual(body.Tools[0].InputSchema, tt.wantSchema) {
+				t.Errorf("tools = %+v, want the format tool with %v", body.Tools, tt.wantSchema)
+			}
+			if body.ToolChoice["type"] != "tool" || body.ToolChoice["name"] != anthropicFormatTool {
+				t.Errorf("tool_choice = %v, want the format tool", body.ToolChoice)
+			}
+
+			// the input of the format tool is the answer, no tool runs
+			if rslt.IsToolCall || rslt.LlmRes != `{"sentiment":"positive"}` || rslt.FinishReason != service.FinishStop {
+				t.Errorf("IsToolCall = %v, answer = %q, FinishReason = %q, want the JSON answer", rslt.IsToolCall, rslt.LlmRes, rslt.FinishReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaults of CircuitBreakerConfig
+const (
+	defaultBreakerWindow   = 20
+	defaultBreakerMinCalls = 5
+	defaultBreakerOpen     = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned without calling a provider whose circuit is open
+var ErrCircuitOpen = errors.New("circuit open")
+
+// CircuitBreakerLLMService refuses calls to a provider whose recent calls
+// failed or were slow too often, and reports the provider's health. It wraps
+// the retry policy, so a call counts once however many attempts it took.
+type CircuitBreakerLLMService struct {
+	svc  service.LLMService
+	name string
+	cfg  config.CircuitBreakerConfig
+
+	mu        sync.Mutex
+	state     string
+	window    []callOutcome // ring of the latest calls
+	next      int
+	openedAt  time.Time
+	trials    int // trial calls in flight while half open
+	successes int // trial calls that succeeded
+	lastErr   string
+}
+
+type callOutcome struct {
+	failed  bool
+	slow    bool
+	latency time.Duration
+}
+
+// NewCircuitBreakerLLMService creates a new instance of CircuitBreakerLLMService
+func NewCircuitBreakerLLMService(name string, svc service.LLMService, cfg config.CircuitBreakerConfig) *CircuitBreakerLLMService {
+	if cfg.Window <= 0 {
+		cfg.Window = defaultBreakerWindow
+	}
+	if cfg.MinCalls <= 0 {
+		cfg.MinCalls = defaultBreakerMinCalls
+	}
+	if cfg.OpenSeconds <= 0 {
+		cfg.OpenSeconds = int(defaultBreakerOpen / time.Second)
+	}
+	if cfg.HalfOpenCalls <= 0 {
+		cfg.HalfOpenCalls = 1
+	}
+	return &CircuitBreakerLLMService{svc: svc, name: name, cfg: cfg, state: service.CircuitClosed}
+}
+
+func (s *CircuitBreakerLLMService) StreamingCall(ctx context.Context, messages []entity.Message, params service.GenerateParams, writer service.StreamWriter, lastRslt service.LLMResult) (service.LLMResult, error) {
+	trial, ok := s.acquire()
+	if !ok {
+		return lastRslt, errors.Wrapf(ErrCircuitOpen, "api %s", s.name)
+	}
+
+	w := &latencyWriter{StreamWriter: writer, start: time.Now()}
+	rslt, err := s.svc.StreamingCall(ctx, messages, params, w, lastRslt)
+
+	// A cancelled call says nothing about the provider
+	if ctx.Err() != nil {
+		s.release(trial)
+		return rslt, err
+	}
+	latency := w.first
+	if latency == 0 {
+		latency = time.Since(w.start)
+	}
+	s.record(trial, callOutcome{
+		failed:  isProviderFailure(err),
+		slow:    s.cfg.SlowCallMs > 0 && latency > time.Duration(s.cfg.SlowCallMs)*time.Millisecond,
+		latency: latency,
+	}, err)
+	return rslt, err
+}
+
+// isProviderFailure reports whether err is the provider's fault, rejected
+// requests, our own rate limit, input the api does not take and runaway tool
+// calls are not
+func isProviderFailure(err error) bool {
+	if err == nil || errors.Is(err, errToolCallDepth) || errors.Is(err, service.ErrRateLimited) || errors.Is(err, service.ErrUnsupportedInput) {
+		return false
+	}
+	var upErr *UpstreamError
+	if errors.As(err, &upErr) {
+		return upErr.Retryable()
+	}
+	return true
+}
+
+// acquire reports whether a call may go through, and whether it is a trial
+// of a half open circuit
+func (s *CircuitBreakerLLMService) acquire() (trial bool, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == service.CircuitOpen {
+		if time.Since(s.openedAt) < time.Duration(s.cfg.OpenSeconds)*time.Second {
+			return false, false
+		}
+		s.state = service.CircuitHalfOpen
+		s.trials, s.successes = 0, 0
+	}
+	if s.state == service.CircuitHalfOpen {
+		if s.trials+s.successes >= s.cfg.HalfOpenCalls {
+			return false, false
+		}
+		s.trials++
+		return true, true
+	}
+	return false, true
+}
+
+func (s *CircuitBreakerLLMService) release(trial bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if trial && s.state == service.CircuitHalfOpen {
+		s.trials--
+	}
+}
+
+func (s *CircuitBreakerLLMService) record(trial bool, out callOutcome, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil && out.failed {
+		s.lastErr = err.Error()
+	}
+
+	switch {
+	case trial && s.state == service.CircuitHalfOpen:
+		s.trials--
+		if out.failed || out.slow {
+			s.trip()
+			return
+		}
+		s.successes++
+		if s.successes >= s.cfg.HalfOpenCalls {
+			s.state = service.CircuitClosed
+			s.window, s.next = nil, 0
+		}
+	case s.state == service.CircuitClosed:
+		if len(s.window) < s.cfg.Window {
+			s.window = append(s.window, out)
+		} else {
+			s.window[s.next] = out
+			s.next = (s.next + 1) % s.cfg.Window
+		}
+		if len(s.window) < s.cfg.MinCalls {
+			return
+		}
+		failures, slow := s.counts()
+		n := float64(len(s.window))
+		if (s.cfg.ErrorRate > 0 && float64(failures)/n >= s.cfg.ErrorRate) ||
+			(s.cfg.SlowCallRate > 0 && float64(slow)/n >= s.cfg.SlowCallRate) {
+			s.trip()
+		}
+	}
+}
+
+func (s *CircuitBreakerLLMService) trip() {
+	s.state = service.CircuitOpen
+	s.openedAt = time.Now()
+	s.trials, s.successes = 0, 0
+	fmt.Printf("circuit of api %s opened for %ds\n", s.name, s.cfg.OpenSeconds)
+}
+
+func (s *CircuitBreakerLLMService) counts() (failures, slow int) {
+	for _, c := range s.window {
+		if c.failed {
+			failures++
+		}
+		if c.slow {
+			slow++
+		}
+	}
+	return failures, slow
+}
+
+// Health returns the circuit state and the statistics of the window
+func (s *CircuitBreakerLLMService) Health() service.ProviderHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := service.ProviderHealth{Name: s.name, State: s.state, Calls: len(s.window), LastError: s.lastErr}
+	h.Failures, h.SlowCalls = s.counts()
+	if h.Calls > 0 {
+		var total time.Duration
+		for _, c := range s.window {
+			total += c.latency
+		}
+		h.ErrorRate = float64(h.Failures) / float64(h.Calls)
+		h.AvgLatencyMs = (total / time.Duration(h.Calls)).Milliseconds()
+	}
+	if s.state == service.CircuitOpen {
+		retryAt := s.openedAt.Add(time.Duration(s.cfg.OpenSeconds) * time.Second)
+		if time.Now().Before(retryAt) {
+			h.RetryAt = &retryAt
+		} else {
+			// The next call is let through as a trial
+			h.State = service.CircuitHalfOpen
+		}
+	}
+	return h
+}
+
+// latencyWriter notes the time to the first output of a call, status notices do not count
+type latencyWriter struct {
+	service.StreamWriter
+	start time.Time
+	first time.Duration
+}
+
+func (w *latencyWriter) Send(event service.StreamEvent) error {
+	if w.first == 0 && event.Type != service.EventStatus {
+		w.first = time.Since(w.start)
+	}
+	return w.StreamWriter.Send(event)
+}
@@ -0,0 +1,138 @@
+package llm
+
+import (
+	"context"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// stubLLMService answers every call with err, counting the calls
+type stubLLMService struct {
+	err   error
+	calls int
+}
+
+func (s *stubLLMService) StreamingCall(ctx context.Context, messages []entity.Message, params service.GenerateParams, writer service.StreamWriter, lastRslt service.LLMResult) (service.LLMResult, error) {
+	s.calls++
+	return lastRslt, s.err
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	failure := &UpstreamError{StatusCode: http.StatusServiceUnavailable}
+	rejected := &UpstreamError{StatusCode: http.StatusBadRequest}
+
+	// step is one call, or the open period running out when elapse is set
+	type step struct {
+		err       error
+		elapse    bool
+		refused   bool // the call must not reach the provider
+		wantState string
+	}
+	tests := []struct {
+		name  string
+		cfg   config.CircuitBreakerConfig
+		steps []step
+	}{
+		{
+			name: "opens once the error rate is reached over min calls",
+			cfg:  config.CircuitBreakerConfig{MinCalls: 3, ErrorRate: 0.5},
+			steps: []step{
+				{err: failure, wantState: service.CircuitClosed},
+				{err: nil, wantState: service.CircuitClosed},
+				{err: failure, wantState: service.CircuitOpen},
+				{refused: true, wantState: service.CircuitOpen},
+			},
+		},
+		{
+			name: "rejected requests and our own rate limit do not count",
+			cfg:  config.CircuitBreakerConfig{MinCalls: 2, ErrorRate: 0.5},
+			steps: []step{
+				{err: rejected, wantState: service.CircuitClosed},
+				{err: service.ErrRateLimited, wantState: service.CircuitClosed},
+				{err: errToolCallDepth, wantState: service.CircuitClosed},
+			},
+		},
+		{
+			name: "never opens without rates",
+			cfg:  config.CircuitBreakerConfig{MinCalls: 1},
+			steps: []step{
+				{err: failure, wantState: service.CircuitClosed},
+				{err: failure, wantState: service.CircuitClosed},
+			},
+		},
+		{
+			name: "successful trial closes",
+			cfg:  config.CircuitBreakerConfig{MinCalls: 1, ErrorRate: 1},
+			steps: []step{
+				{err: failure, wantState: service.CircuitOpen},
+				{elapse: true, wantState: service.CircuitHalfOpen},
+				{err: nil, wantState: service.CircuitClosed},
+				{err: nil, wantState: service.CircuitClosed},
+			},
+		},
+		{
+			name: "failed trial opens again",
+			cfg:  config.CircuitBreakerConfig{MinCalls: 1, ErrorRate: 1},
+			steps: []step{
+				{err: failure, wantState: service.CircuitOpen},
+				{elapse: true, wantState: service.CircuitHalfOpen},
+				{err: failure, wantState: service.CircuitOpen},
+				{refused: true, wantState: service.CircuitOpen},
+			},
+		},
+		{
+			name: "every half open call must succeed",
+			cfg:  config.CircuitBreakerConfig{MinCalls: 1, ErrorRate: 1, HalfOpenCalls: 2},
+			steps: []step{
+				{err: failure, wantState: service.CircuitOpen},
+				{elapse: true, wantState: service.CircuitHalfOpen},
+				{err: nil, wantState: service.CircuitHalfOpen},
+				{err: nil, wantState: service.CircuitClosed},
+			},
+		},
+		{
+			name: "rates are taken over the latest calls",
+			cfg:  config.CircuitBreakerConfig{Window: 2, MinCalls: 2, ErrorRate: 1},
+			steps: []step{
+				{err: failure, wantState: service.CircuitClosed},
+				{err: nil, wantState: service.CircuitClosed},
+				{err: failure, wantState: service.CircuitClosed},
+				{err: failure, wantState: service.CircuitOpen},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubLLMService{}
+			cb := NewCircuitBreakerLLMService("test", stub, tt.cfg)
+
+			for i, st := range tt.steps {
+				if st.elapse {
+					cb.mu.Lock()
+					cb.openedAt = cb.openedAt.Add(-time.Duration(cb.cfg.OpenSeconds) * time.Second)
+					cb.mu.Unlock()
+				} else {
+					stub.err = st.err
+					before := stub.calls
+					_, err := cb.StreamingCall(context.Background(), nil, service.GenerateParams{}, &eventRecorder{}, service.LLMResult{})
+					called := stub.calls > before
+					if called == st.refused {
+						t.Fatalf("step %d: provider called = %v, want %v", i, called, !st.refused)
+					}
+					if st.refused && !errors.Is(err, ErrCircuitOpen) {
+						t.Errorf("step %d: err = %v, want ErrCircuitOpen", i, err)
+					}
+				}
+				if got := cb.Health().State; got != st.wantState {
+					t.Errorf("step %d: state = %s, want %s", i, got, st.wantState)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// FallbackLLMService routes each call to the api.json entry named by the
+// request, or tries its chain in order, moving on to the next entry when a
+// call fails before anything was written to the stream. A call refused by the
+// rate limit of an api is not retried elsewhere.
+type FallbackLLMService struct {
+	providers map[string]service.LLMService // every api.json entry by name
+	chain     []string                      // entries tried when the request names no api
+}
+
+// NewFallbackLLMService creates a new instance of FallbackLLMService
+func NewFallbackLLMService(providers map[string]service.LLMService, chain []string) *FallbackLLMService {
+	return &FallbackLLMService{providers, chain}
+}
+
+func (s *FallbackLLMService) StreamingCall(ctx context.Context, messages []entity.Message, params service.GenerateParams, writer service.StreamWriter, lastRslt service.LLMResult) (service.LLMResult, error) {
+	var rslt service.LLMResult
+	var err error
+
+	// An explicitly requested api is used alone so that comparisons stay honest
+	chain := s.chain
+	if params.Api != "" {
+		chain = []string{params.Api}
+	}
+
+	for _, name := range chain {
+		svc, ok := s.providers[name]
+		if !ok {
+			err = fmt.Errorf("api %s not found", name)
+			continue
+		}
+
+		w := &trackingWriter{StreamWriter: writer}
+		rslt, err = svc.StreamingCall(ctx, messages, params, w, lastRslt)
+		rslt.Provider = name
+		if err == nil {
+			return rslt, nil
+		}
+
+		// Once the client saw output, or the request itself is gone, switching
+		// provider would only garble the answer
+		if w.written || ctx.Err() != nil || errors.Is(err, errToolCallDepth) {
+			return rslt, err
+		}
+		// Our own rate limit refused the call, it is the caller's to retry later
+		if errors.Is(err, service.ErrRateLimited) {
+			return rslt, err
+		}
+		if errors.Is(err, ErrCircuitOpen) {
+			fmt.Printf("provider %s skipped, circuit open\n", name)
+			continue
+		}
+		fmt.Printf("provider %s failed, try next: %v\n", name, err)
+	}
+
+	if err == nil {
+		err = fmt.Errorf("no llm provider configured")
+	}
+	return rslt, errors.Wrap(err, "all providers failed")
+}
+
+// ProvidersHealth returns the health of every provider that tracks it, by name
+func (s *FallbackLLMService) ProvidersHealth() []service.ProviderHealth {
+	names := make([]string, 0, len(s.providers))
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var health []service.ProviderHealth
+	for _, name := range names {
+		if b, ok := s.providers[name].(*CircuitBreakerLLMService); ok {
+			health = append(health, b.Health())
+		}
+	}
+	return health
+}
+
+// trackingWriter records whether output reached the underlying StreamWriter,
+// status notices do not count
+type trackingWriter struct {
+	service.StreamWriter
+	written bool
+}
+
+func (w *trackingWriter) Send(event service.StreamEvent) error {
+	if event.Type != service.EventStatus {
+		w.written = true
+	}
+	return w.StreamWriter.Send(event)
+}
@@ -0,0 +1,44 @@
+package llm
+
+import (
+	"context"
+	"kepatrick/llm-playground/internal/domain/service"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestFallbackLLMService(t *testing.T) {
+	tests := []struct {
+		name         string
+		primaryErr   error
+		wantErr      error
+		wantProvider string
+		wantFallback bool
+	}{
+		{"success", nil, nil, "primary", false},
+		{"upstream failure falls back", &UpstreamError{StatusCode: http.StatusServiceUnavailable}, nil, "fallback", true},
+		{"open circuit falls back", ErrCircuitOpen, nil, "fallback", true},
+		{"rate limited does not fall back", service.ErrRateLimited, service.ErrRateLimited, "primary", false},
+		{"tool call depth does not fall back", errToolCallDepth, errToolCallDepth, "primary", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := &stubLLMService{err: tt.primaryErr}
+			fallback := &stubLLMService{}
+			svc := NewFallbackLLMService(map[string]service.LLMService{"primary": primary, "fallback": fallback}, []string{"primary", "fallback"})
+
+			rslt, err := svc.StreamingCall(context.Background(), nil, service.GenerateParams{}, &eventRecorder{}, service.LLMResult{})
+			if tt.wantErr == nil && err != nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if rslt.Provider != tt.wantProvider {
+				t.Errorf("provider = %q, want %q", rslt.Provider, tt.wantProvider)
+			}
+			if called := fallback.calls > 0; called != tt.wantFallback {
+				t.Errorf("fallback called = %v, want %v", called, tt.wantFallback)
+			}
+		})
+	}
+}
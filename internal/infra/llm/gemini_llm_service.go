@@ -0,0 +1,372 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GeminiLLMService handles interactions with the Gemini generateContent API
+type GeminiLLMService struct {
+	apiKey string       // API key for authentication
+	apiUrl string       // API base URL, e.g. https://generativelanguage.googleapis.com/v1beta
+	model  string       // model
+	client *http.Client // HTTP client for making requests
+	tools  []config.Tool
+}
+
+// geminiChunk is one SSE chunk of the streamGenerateContent stream
+type geminiChunk struct {
+	Candidates []struct {
+		Content struct {
+			Parts []struct {
+				Text         string `json:"text"`
+				FunctionCall *struct {
+					ID   string          `json:"id"`
+					Name string          `json:"name"`
+					Args json.RawMessage `json:"args"`
+				} `json:"functionCall"`
+			} `json:"parts"`
+		} `json:"content"`
+		FinishReason string `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata struct {
+		PromptTokenCount        int `json:"promptTokenCount"`
+		CandidatesTokenCount    int `json:"candidatesTokenCount"`
+		CachedContentTokenCount int `json:"cachedContentTokenCount"` // part of promptTokenCount
+	} `json:"usageMetadata"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+// NewGeminiLLMService creates a new instance of GeminiLLMService
+func NewGeminiLLMService(key, url, model string, cli *http.Client, tools []config.Tool) *GeminiLLMService {
+	return &GeminiLLMService{key, url, model, cli, tools}
+}
+
+func (s *GeminiLLMService) StreamingCall(ctx context.Context, messages []entity.Message, params service.GenerateParams, writer service.StreamWriter, lastRslt service.LLMResult) (service.LLMResult, error) {
+	var builder strings.Builder
+	var curReqToken int
+	var curResToken int
+	var cachedToken int
+	var finishReason string
+
+	depth := lastRslt.ToolCallDepth + 1
+	reqTokens := lastRslt.ReqToken
+	resTokens := lastRslt.ResToken
+
+	functionCalls := []*FunctionCall{}
+
+	if depth > maxToolCallDepth {
+		return buildLLMRslt("tool calling out of limit", false, depth, reqTokens, resTokens, nil), errToolCallDepth
+	}
+
+	system, contents, err := s.buildContents(messages)
+	if err != nil {
+		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), err
+	}
+
+	// Prepare request body
+	body := map[string]interface{}{
+		"contents": contents,
+	}
+	if system != "" {
+		body["systemInstruction"] = map[string]interface{}{
+			"parts": []map[string]interface{}{{"text": system}},
+		}
+	}
+	tools := offeredTools(s.tools, params)
+	if len(tools) > 0 {
+		body["tools"] = []map[string]interface{}{{
+			"functionDeclarations": s.prepareReqTools(tools),
+		}}
+	}
+	if genCfg := s.buildGenerationConfig(params); len(genCfg) > 0 {
+		body["generationConfig"] = genCfg
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), errors.Wrap(err, "marshal stream body")
+	}
+
+	// Create HTTP request, alt=sse switches the stream from a JSON array to SSE
+	url := strings.TrimSuffix(s.apiUrl, "/") + "/models/" + s.model + ":streamGenerateContent?alt=sse"
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
+	req.Header.Set("x-goog-api-key", s.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	// Execute request
+	res, err := s.client.Do(req)
+	if err != nil {
+		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), err
+	}
+	defer res.Body.Close()
+
+	// Check http status
+	if res.StatusCode != http.StatusOK {
+		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), newUpstreamError(res)
+	}
+
+	// Read response stream
+	rd := newSSEReader(res.Body)
+	for {
+		evt, err := rd.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), err
+		}
+
+		var event geminiChunk
+		if err := json.Unmarshal([]byte(evt.Data), &event); err != nil {
+			return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), &StreamFormatError{Provider: ProviderGemini, Frame: evt.Data, Err: err}
+		}
+		if event.Error != nil {
+			return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), fmt.Errorf("stream upstream error %d %s: %s", event.Error.Code, event.Error.Status, event.Error.Message)
+		}
+
+		// usageMetadata is cumulative, the last chunk holds the totals
+		if event.UsageMetadata.PromptTokenCount > 0 {
+			curReqToken = event.UsageMetadata.PromptTokenCount
+			curResToken = event.UsageMetadata.CandidatesTokenCount
+			cachedToken = event.UsageMetadata.CachedContentTokenCount
+		}
+
+		if len(event.Candidates) == 0 {
+			continue
+		}
+		if event.Candidates[0].FinishReason != "" {
+			finishReason = event.Candidates[0].FinishReason
+		}
+		for _, part := range event.Candidates[0].Content.Parts {
+			if part.FunctionCall != nil {
+				// Gemini sends function calls complete, the id is optional
+				id := part.FunctionCall.ID
+				if id == "" {
+					id = fmt.Sprintf("call_%d_%d", depth, len(functionCalls))
+				}
+				fc := &FunctionCall{Index: len(functionCalls), ID: id, Name: part.FunctionCall.Name}
+				if len(part.FunctionCall.Args) > 0 {
+					fc.Arguments.Write(part.FunctionCall.Args)
+				} else {
+					fc.Arguments.WriteString("{}")
+				}
+				functionCalls = append(functionCalls, fc)
+				writer.Send(service.ToolCallStartEvent(fc.ID, fc.Index, fc.Name))
+				writer.Send(service.ToolCallArgsEvent(fc.ID, fc.Index, fc.Arguments.String()))
+				continue
+			}
+			if part.Text != "" {
+				builder.WriteString(part.Text)
+				writer.Send(service.TokenEvent(part.Text))
+			}
+		}
+	}
+	reqTokens += curReqToken
+	resTokens += curResToken
+
+	if len(functionCalls) > 0 {
+		messages = appendToolCallMessages(ctx, messages, builder.String(), "", tools, functionCalls, writer)
+		// return with toolcall
+		rslt := buildLLMRslt("", true, depth, reqTokens, resTokens, messages)
+		rslt.CachedToken = cachedToken
+		rslt.FinishReason = service.FinishToolCalls
+		return rslt, nil
+	}
+
+	if builder.Len() > 0 {
+		messages = append(messages, entity.Message{
+			Role:      "assistant",
+			Content:   builder.String(),
+			Timestamp: nowMilli(),
+		})
+	}
+
+	rslt := buildLLMRslt(builder.String(), false, depth, reqTokens, resTokens, messages)
+	rslt.CachedToken = cachedToken
+	rslt.FinishReason = geminiFinishReason(finishReason)
+	return rslt, nil
+}
+
+// geminiFinishReason maps a candidate finishReason to a service finish reason
+func geminiFinishReason(reason string) string {
+	switch reason {
+	case "STOP":
+		return service.FinishStop
+	case "MAX_TOKENS":
+		return service.FinishLength
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return service.FinishContentFilter
+	case "":
+		return ""
+	}
+	return strings.ToLower(reason)
+}
+
+// buildContents converts the session history into the system instruction and
+// Gemini contents. Assistant turns use the "model" role, tool results become
+// functionResponse parts of a user turn, and consecutive turns of the same
+// role are merged into one.
+func (s *GeminiLLMService) buildContents(raw []entity.Message) (string, []map[string]interface{}, error) {
+	var system []string
+	var contents []map[string]interface{}
+
+	// functionResponse needs the function name, which tool messages do not carry
+	callNames := map[string]string{}
+
+	for _, m := range raw {
+		var role string
+		var parts []map[string]interface{}
+
+		switch m.Role {
+		case "system":
+			system = append(system, m.Content)
+			continue
+		case "tool":
+			role = "user"
+			parts = append(parts, map[string]interface{}{
+				"functionResponse": map[string]interface{}{
+					"name":     callNames[m.ToolCallID],
+					"response": map[string]interface{}{"content": m.Content},
+				},
+			})
+		case "assistant":
+			role = "model"
+			if m.Content != "" {
+				parts = append(parts, map[string]interface{}{"text": m.Content})
+			}
+			for _, tc := range m.ToolCalls {
+				id, _ := tc["id"].(string)
+				fn, _ := tc["function"].(map[string]interface{})
+				name, _ := fn["name"].(string)
+				args, _ := fn["arguments"].(string)
+				callNames[id] = name
+
+				argsObj := json.RawMessage("{}")
+				if args != "" && json.Valid([]byte(args)) {
+					argsObj = json.RawMessage(args)
+				}
+				parts = append(parts, map[string]interface{}{
+					"functionCall": map[string]interface{}{
+						"name": name,
+						"args": argsObj,
+					},
+				})
+			}
+		default:
+			role = "user"
+			if len(m.Parts) > 0 {
+				converted, err := geminiContentParts(m.Parts)
+				if err != nil {
+					return "", nil, err
+				}
+				parts = append(parts, converted...)
+			} else if m.Content != "" {
+				parts = append(parts, map[string]interface{}{"text": m.Content})
+			}
+		}
+
+		if len(parts) == 0 {
+			continue
+		}
+		if n := len(contents); n > 0 && contents[n-1]["role"] == role {
+			contents[n-1]["parts"] = append(contents[n-1]["parts"].([]map[string]interface{}), parts...)
+			continue
+		}
+		contents = append(contents, map[string]interface{}{
+			"role":  role,
+			"parts": parts,
+		})
+	}
+	return strings.Join(system, "\n\n"), contents, nil
+}
+
+// geminiContentParts converts multimodal parts into Gemini parts, images are
+// sent as inlineData. Gemini cannot fetch arbitrary image urls.
+func geminiContentParts(parts []entity.ContentPart) ([]map[string]interface{}, error) {
+	var results []map[string]interface{}
+	for _, p := range parts {
+		switch p.Type {
+		case entity.PartText:
+			results = append(results, map[string]interface{}{"text": p.Text})
+		case entity.PartImageURL:
+			return nil, errors.Wrap(service.ErrUnsupportedInput, "gemini takes uploaded images only, not image urls")
+		case entity.PartImage:
+			results = append(results, map[string]interface{}{
+				"inlineData": map[string]interface{}{"mimeType": p.MediaType, "data": p.Data},
+			})
+		}
+	}
+	return results, nil
+}
+
+// prepareReqTools converts tool definitions into Gemini functionDeclarations,
+// parameters are left out for tools without properties as Gemini rejects
+// empty object schemas
+func (s *GeminiLLMService) prepareReqTools(tools []config.Tool) []map[string]interface{} {
+	results := make([]map[string]interface{}, 0, len(tools))
+	for _, t := range tools {
+		decl := map[string]interface{}{
+			"name":        t.Function.Name,
+			"description": t.Function.Description,
+		}
+		if len(t.Function.Parameters.Properties) > 0 {
+			params := map[string]interface{}{
+				"type":       t.Function.Parameters.Type,
+				"properties": t.Function.Parameters.Properties,
+			}
+			if len(t.Function.Parameters.Required) > 0 {
+				params["required"] = t.Function.Parameters.Required
+			}
+			decl["parameters"] = params
+		}
+		results = append(results, decl)
+	}
+	return results
+}
+
+// buildGenerationConfig maps the sampling parameters onto Gemini generationConfig
+func (s *GeminiLLMService) buildGenerationConfig(p service.GenerateParams) map[string]interface{} {
+	genCfg := map[string]interface{}{}
+	if p.Temperature != nil {
+		genCfg["temperature"] = *p.Temperature
+	}
+	if p.TopP != nil {
+		genCfg["topP"] = *p.TopP
+	}
+	if p.MaxTokens != nil {
+		genCfg["maxOutputTokens"] = *p.MaxTokens
+	}
+	if len(p.Stop) > 0 {
+		genCfg["stopSequences"] = p.Stop
+	}
+	if p.Seed != nil {
+		genCfg["seed"] = *p.Seed
+	}
+	if p.PresencePenalty != nil {
+		genCfg["presencePenalty"] = *p.PresencePenalty
+	}
+	if p.FrequencyPenalty != nil {
+		genCfg["frequencyPenalty"] = *p.FrequencyPenalty
+	}
+	if f := p.ResponseFormat; f != nil {
+		genCfg["responseMimeType"] = "application/json"
+		if f.Type == "json_schema" {
+			genCfg["responseJsonSchema"] = f.Schema
+		}
+	}
+	return genCfg
+}
@@ -0,0 +1,117 @@
+package llm
+
+import (
+	"context"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// geminiStream is a recorded streamGenerateContent?alt=sse stream: text, then
+// two complete function calls, one without an id, and cumulative usage
+const geminiStream = `data: {"candidates":[{"content":{"role":"model","parts":[{"text":"Let me "}]}}],"usageMetadata":{"promptTokenCount":30,"candidatesTokenCount":2}}
+
+data: {"candidates":[{"content":{"role":"model","parts":[{"text":"check."}]}}],"usageMetadata":{"promptTokenCount":30,"candidatesTokenCount":4}}
+
+data: {"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"id":"fc_a","name":"get_weather","args":{"city":"Paris"}}},{"functionCall":{"name":"get_time"}}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":30,"candidatesTokenCount":12,"cachedContentTokenCount":16}}
+
+`
+
+func TestGeminiStreamToolCalls(t *testing.T) {
+	var path string
+	srv, _ := replayServer(t, "text/event-stream", geminiStream)
+	svc := NewGeminiLLMService("key", srv.URL+"/v1beta", "gemini-pro", &http.Client{Transport: pathRecorder{&path}}, nil)
+	w := &eventRecorder{}
+
+	msgs := []entity.Message{{Role: "user", Content: "weather?"}}
+	rslt, err := svc.StreamingCall(context.Background(), msgs, service.GenerateParams{}, w, service.LLMResult{})
+	if err != nil {
+		t.Fatalf("StreamingCall: %v", err)
+	}
+	if path != "/v1beta/models/gemini-pro:streamGenerateContent" {
+		t.Errorf("request path = %q", path)
+	}
+
+	if !rslt.IsToolCall || rslt.FinishReason != service.FinishToolCalls {
+		t.Errorf("IsToolCall = %v, FinishReason = %q, want a tool call", rslt.IsToolCall, rslt.FinishReason)
+	}
+	// usageMetadata is cumulative, only the last chunk counts
+	if rslt.ReqToken != 30 || rslt.ResToken != 12 || rslt.CachedToken != 16 {
+		t.Errorf("tokens = %d/%d cached %d, want 30/12 cached 16", rslt.ReqToken, rslt.ResToken, rslt.CachedToken)
+	}
+
+	if len(rslt.Messages) != len(msgs)+3 {
+		t.Fatalf("got %d messages, want %d", len(rslt.Messages), len(msgs)+3)
+	}
+	assistant := rslt.Messages[len(msgs)]
+	if assistant.Content != "Let me check." {
+		t.Errorf("content = %q, want %q", assistant.Content, "Let me check.")
+	}
+	want := [][3]string{
+		{"fc_a", "get_weather", `{"city":"Paris"}`},
+		{"call_1_1", "get_time", `{}`},
+	}
+	if len(assistant.ToolCalls) != len(want) {
+		t.Fatalf("got %d tool calls, want %d", len(assistant.ToolCalls), len(want))
+	}
+	for i, tc := range assistant.ToolCalls {
+		id, name, args := toolCallOf(tc)
+		if [3]string{id, name, args} != want[i] {
+			t.Errorf("tool call %d = %v, want %v", i, [3]string{id, name, args}, want[i])
+		}
+	}
+	if n := w.count(service.EventToolCallArgs); n != 2 {
+		t.Errorf("got %d tool call args events, want 2", n)
+	}
+}
+
+func TestGeminiStreamFinishReason(t *testing.T) {
+	tests := []struct {
+		reason string
+		want   string
+	}{
+		{"STOP", service.FinishStop},
+		{"MAX_TOKENS", service.FinishLength},
+		{"SAFETY", service.FinishContentFilter},
+		{"RECITATION", service.FinishContentFilter},
+		{"MALFORMED_FUNCTION_CALL", "malformed_function_call"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			stream := `data: {"candidates":[{"content":{"parts":[{"text":"Hi"}]},"finishReason":"` + tt.reason + `"}],"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":1}}` + "\n\n"
+			srv, _ := replayServer(t, "text/event-stream", stream)
+			svc := NewGeminiLLMService("key", srv.URL, "gemini-pro", http.DefaultClient, nil)
+
+			rslt, err := svc.StreamingCall(context.Background(), []entity.Message{{Role: "user", Content: "hi"}}, service.GenerateParams{}, &eventRecorder{}, service.LLMResult{})
+			if err != nil {
+				t.Fatalf("StreamingCall: %v", err)
+			}
+			if rslt.FinishReason != tt.want || rslt.LlmRes != "Hi" {
+				t.Errorf("answer %q FinishReason = %q, want %q", rslt.LlmRes, rslt.FinishReason, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeminiStreamError(t *testing.T) {
+	stream := `data: {"error":{"code":429,"message":"Resource exhausted","status":"RESOURCE_EXHAUSTED"}}` + "\n\n"
+	srv, _ := replayServer(t, "text/event-stream", stream)
+	svc := NewGeminiLLMService("key", srv.URL, "gemini-pro", http.DefaultClient, nil)
+
+	_, err := svc.StreamingCall(context.Background(), []entity.Message{{Role: "user", Content: "hi"}}, service.GenerateParams{}, &eventRecorder{}, service.LLMResult{})
+	if err == nil || !strings.Contains(err.Error(), "RESOURCE_EXHAUSTED") {
+		t.Errorf("err = %v, want the upstream RESOURCE_EXHAUSTED", err)
+	}
+}
+
+// pathRecorder keeps the path of the requests it sends on
+type pathRecorder struct {
+	path *string
+}
+
+func (p pathRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	*p.path = req.URL.Path
+	return http.DefaultTransport.RoundTrip(req)
+}
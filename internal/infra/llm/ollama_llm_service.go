@@ -0,0 +1,277 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// OllamaLLMService handles interactions with the Ollama native /api/chat endpoint
+type OllamaLLMService struct {
+	apiKey string       // optional API key, for Ollama behind an authenticating proxy
+	apiUrl string       // API endpoint URL
+	model  string       // model
+	client *http.Client // HTTP client for making requests
+	tools  []config.Tool
+}
+
+// ollamaFrame is one NDJSON frame of the /api/chat stream
+type ollamaFrame struct {
+	Message struct {
+		Content   string `json:"content"`
+		Thinking  string `json:"thinking"` // set by thinking models
+		ToolCalls []struct {
+			Function struct {
+				Name      string          `json:"name"`
+				Arguments json.RawMessage `json:"arguments"`
+			} `json:"function"`
+		} `json:"tool_calls"`
+	} `json:"message"`
+	Done            bool   `json:"done"`
+	DoneReason      string `json:"done_reason"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	Error           string `json:"error"`
+}
+
+// NewOllamaLLMService creates a new instance of OllamaLLMService
+func NewOllamaLLMService(key, url, model string, cli *http.Client, tools []config.Tool) *OllamaLLMService {
+	return &OllamaLLMService{key, url, model, cli, tools}
+}
+
+func (s *OllamaLLMService) StreamingCall(ctx context.Context, messages []entity.Message, params service.GenerateParams, writer service.StreamWriter, lastRslt service.LLMResult) (service.LLMResult, error) {
+	var builder strings.Builder
+	var reasoning strings.Builder
+	var curReqToken int
+	var curResToken int
+	var doneReason string
+
+	depth := lastRslt.ToolCallDepth + 1
+	reqTokens := lastRslt.ReqToken
+	resTokens := lastRslt.ResToken
+
+	functionCalls := []*FunctionCall{}
+
+	if depth > maxToolCallDepth {
+		return buildLLMRslt("tool calling out of limit", false, depth, reqTokens, resTokens, nil), errToolCallDepth
+	}
+
+	msgs, err := s.buildMessages(messages)
+	if err != nil {
+		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), err
+	}
+
+	// Prepare request body with streaming enabled
+	body := map[string]interface{}{
+		"model":    s.model,
+		"messages": msgs,
+		"stream":   true,
+	}
+	tools := offeredTools(s.tools, params)
+	if len(tools) > 0 {
+		body["tools"] = prepareReqTools(tools)
+	}
+	if options := s.buildOptions(params); len(options) > 0 {
+		body["options"] = options
+	}
+	// format takes "json" or the JSON schema itself
+	if f := params.ResponseFormat; f != nil {
+		if f.Type == "json_schema" {
+			body["format"] = f.Schema
+		} else {
+			body["format"] = "json"
+		}
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), errors.Wrap(err, "marshal stream body")
+	}
+
+	// Create HTTP request
+	req, _ := http.NewRequestWithContext(ctx, "POST", s.apiUrl, bytes.NewBuffer(data))
+	if s.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Execute request
+	res, err := s.client.Do(req)
+	if err != nil {
+		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), err
+	}
+	defer res.Body.Close()
+
+	// Check http status
+	if res.StatusCode != http.StatusOK {
+		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), newUpstreamError(res)
+	}
+
+	// Read response stream, every line is a complete JSON frame
+	rd := bufio.NewReader(res.Body)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), err
+		}
+
+		if chunk := strings.TrimSpace(line); chunk != "" {
+			var frame ollamaFrame
+			if err := json.Unmarshal([]byte(chunk), &frame); err != nil {
+				return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), &StreamFormatError{Provider: ProviderOllama, Frame: chunk, Err: err}
+			}
+			if frame.Error != "" {
+				return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), fmt.Errorf("stream upstream error: %s", frame.Error)
+			}
+
+			// Ollama sends every tool call complete within a single frame
+			for _, tc := range frame.Message.ToolCalls {
+				fc := &FunctionCall{
+					Index: len(functionCalls),
+					ID:    fmt.Sprintf("call_%d_%d", depth, len(functionCalls)),
+					Name:  tc.Function.Name,
+				}
+				fc.Arguments.Write(tc.Function.Arguments)
+				functionCalls = append(functionCalls, fc)
+				writer.Send(service.ToolCallStartEvent(fc.ID, fc.Index, fc.Name))
+				writer.Send(service.ToolCallArgsEvent(fc.ID, fc.Index, fc.Arguments.String()))
+			}
+
+			if thinking := frame.Message.Thinking; thinking != "" {
+				reasoning.WriteString(thinking)
+				writer.Send(service.ReasoningEvent(thinking))
+			}
+
+			if content := frame.Message.Content; content != "" {
+				builder.WriteString(content)
+				writer.Send(service.TokenEvent(content))
+			}
+
+			if frame.Done {
+				curReqToken = frame.PromptEvalCount
+				curResToken = frame.EvalCount
+				doneReason = frame.DoneReason
+				break
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	reqTokens += curReqToken
+	resTokens += curResToken
+
+	if len(functionCalls) > 0 {
+		messages = appendToolCallMessages(ctx, messages, builder.String(), reasoning.String(), tools, functionCalls, writer)
+		// return with toolcall
+		rslt := buildLLMRslt("", true, depth, reqTokens, resTokens, messages)
+		rslt.FinishReason = service.FinishToolCalls
+		return rslt, nil
+	}
+
+	if builder.Len() > 0 || reasoning.Len() > 0 {
+		messages = append(messages, entity.Message{
+			Role:             "assistant",
+			Content:          builder.String(),
+			ReasoningContent: reasoning.String(),
+			Timestamp:        nowMilli(),
+		})
+	}
+
+	// done_reason is already stop or length
+	rslt := buildLLMRslt(builder.String(), false, depth, reqTokens, resTokens, messages)
+	rslt.FinishReason = doneReason
+	return rslt, nil
+}
+
+// buildMessages constructs the /api/chat message array, Ollama expects tool
+// call arguments as JSON objects rather than encoded strings and images as a
+// list of base64 strings next to the content
+func (s *OllamaLLMService) buildMessages(raw []entity.Message) ([]map[string]interface{}, error) {
+	var msgs []map[string]interface{}
+	for _, m := range raw {
+		entry := map[string]interface{}{
+			"role":    m.Role,
+			"content": m.Content,
+		}
+		// The text of a multimodal message is its content, images go apart as base64
+		if len(m.Parts) > 0 {
+			var texts []string
+			var images []string
+			for _, p := range m.Parts {
+				switch p.Type {
+				case entity.PartText:
+					texts = append(texts, p.Text)
+				case entity.PartImageURL:
+					return nil, errors.Wrap(service.ErrUnsupportedInput, "ollama takes uploaded images only, not image urls")
+				case entity.PartImage:
+					images = append(images, p.Data)
+				}
+			}
+			entry["content"] = strings.Join(texts, "\n")
+			if len(images) > 0 {
+				entry["images"] = images
+			}
+		}
+		if len(m.ToolCalls) > 0 {
+			toolCalls := make([]map[string]interface{}, 0, len(m.ToolCalls))
+			for _, tc := range m.ToolCalls {
+				fn, _ := tc["function"].(map[string]interface{})
+				name, _ := fn["name"].(string)
+				args, _ := fn["arguments"].(string)
+
+				arguments := json.RawMessage("{}")
+				if args != "" && json.Valid([]byte(args)) {
+					arguments = json.RawMessage(args)
+				}
+				toolCalls = append(toolCalls, map[string]interface{}{
+					"function": map[string]interface{}{
+						"name":      name,
+						"arguments": arguments,
+					},
+				})
+			}
+			entry["tool_calls"] = toolCalls
+		}
+		msgs = append(msgs, entry)
+	}
+	return msgs, nil
+}
+
+// buildOptions maps the sampling parameters onto Ollama model options
+func (s *OllamaLLMService) buildOptions(p service.GenerateParams) map[string]interface{} {
+	options := map[string]interface{}{}
+	if p.Temperature != nil {
+		options["temperature"] = *p.Temperature
+	}
+	if p.TopP != nil {
+		options["top_p"] = *p.TopP
+	}
+	if p.MaxTokens != nil {
+		options["num_predict"] = *p.MaxTokens
+	}
+	if len(p.Stop) > 0 {
+		options["stop"] = p.Stop
+	}
+	if p.Seed != nil {
+		options["seed"] = *p.Seed
+	}
+	if p.PresencePenalty != nil {
+		options["presence_penalty"] = *p.PresencePenalty
+	}
+	if p.FrequencyPenalty != nil {
+		options["frequency_penalty"] = *p.FrequencyPenalty
+	}
+	return options
+}
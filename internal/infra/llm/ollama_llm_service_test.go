@@ -0,0 +1,115 @@
+package llm
+
+import (
+	"context"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// ollamaStream is a recorded /api/chat NDJSON stream: thinking, text, then
+// two complete tool calls and the final frame with the counts
+const ollamaStream = `{"model":"qwen3","message":{"role":"assistant","content":"","thinking":"The user wants "},"done":false}
+{"model":"qwen3","message":{"role":"assistant","content":"","thinking":"the weather."},"done":false}
+{"model":"qwen3","message":{"role":"assistant","content":"Let me check."},"done":false}
+{"model":"qwen3","message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"get_weather","arguments":{"city":"Paris"}}},{"function":{"name":"get_time","arguments":{}}}]},"done":false}
+{"model":"qwen3","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":40,"eval_count":25}
+`
+
+func TestOllamaStreamToolCalls(t *testing.T) {
+	srv, _ := replayServer(t, "application/x-ndjson", ollamaStream)
+	svc := NewOllamaLLMService("", srv.URL, "qwen3", http.DefaultClient, nil)
+	w := &eventRecorder{}
+
+	msgs := []entity.Message{{Role: "user", Content: "weather?"}}
+	rslt, err := svc.StreamingCall(context.Background(), msgs, service.GenerateParams{}, w, service.LLMResult{ToolCallDepth: 1})
+	if err != nil {
+		t.Fatalf("StreamingCall: %v", err)
+	}
+
+	if !rslt.IsToolCall || rslt.FinishReason != service.FinishToolCalls {
+		t.Errorf("IsToolCall = %v, FinishReason = %q, want a tool call", rslt.IsToolCall, rslt.FinishReason)
+	}
+	if rslt.ReqToken != 40 || rslt.ResToken != 25 {
+		t.Errorf("tokens = %d/%d, want 40/25", rslt.ReqToken, rslt.ResToken)
+	}
+
+	if len(rslt.Messages) != len(msgs)+3 {
+		t.Fatalf("got %d messages, want %d", len(rslt.Messages), len(msgs)+3)
+	}
+	assistant := rslt.Messages[len(msgs)]
+	if assistant.Content != "Let me check." || assistant.ReasoningContent != "The user wants the weather." {
+		t.Errorf("content = %q reasoning = %q", assistant.Content, assistant.ReasoningContent)
+	}
+	// ids are made up from the depth of the call and the position of the tool call
+	want := [][3]string{
+		{"call_2_0", "get_weather", `{"city":"Paris"}`},
+		{"call_2_1", "get_time", `{}`},
+	}
+	if len(assistant.ToolCalls) != len(want) {
+		t.Fatalf("got %d tool calls, want %d", len(assistant.ToolCalls), len(want))
+	}
+	for i, tc := range assistant.ToolCalls {
+		id, name, args := toolCallOf(tc)
+		if [3]string{id, name, args} != want[i] {
+			t.Errorf("tool call %d = %v, want %v", i, [3]string{id, name, args}, want[i])
+		}
+	}
+	if n := w.count(service.EventReasoning); n != 2 {
+		t.Errorf("got %d reasoning events, want 2", n)
+	}
+}
+
+func TestOllamaStreamDoneReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   string
+		answer string
+	}{
+		{
+			name:   "stop",
+			stream: `{"message":{"content":"Hi"},"done":false}` + "\n" + `{"message":{"content":""},"done":true,"done_reason":"stop","prompt_eval_count":3,"eval_count":1}` + "\n",
+			want:   service.FinishStop,
+			answer: "Hi",
+		},
+		{
+			name:   "length",
+			stream: `{"message":{"content":"Hi"},"done":false}` + "\n" + `{"message":{"content":" th"},"done":true,"done_reason":"length","prompt_eval_count":3,"eval_count":2}` + "\n",
+			want:   service.FinishLength,
+			answer: "Hi th",
+		},
+		{
+			name:   "last frame without newline",
+			stream: `{"message":{"content":"Hi"},"done":true,"done_reason":"stop"}`,
+			want:   service.FinishStop,
+			answer: "Hi",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := replayServer(t, "application/x-ndjson", tt.stream)
+			svc := NewOllamaLLMService("", srv.URL, "qwen3", http.DefaultClient, nil)
+
+			rslt, err := svc.StreamingCall(context.Background(), []entity.Message{{Role: "user", Content: "hi"}}, service.GenerateParams{}, &eventRecorder{}, service.LLMResult{})
+			if err != nil {
+				t.Fatalf("StreamingCall: %v", err)
+			}
+			if rslt.FinishReason != tt.want || rslt.LlmRes != tt.answer {
+				t.Errorf("answer %q FinishReason = %q, want %q %q", rslt.LlmRes, rslt.FinishReason, tt.answer, tt.want)
+			}
+		})
+	}
+}
+
+func TestOllamaStreamError(t *testing.T) {
+	srv, _ := replayServer(t, "application/x-ndjson", `{"error":"model \"qwen3\" not found"}`+"\n")
+	svc := NewOllamaLLMService("", srv.URL, "qwen3", http.DefaultClient, nil)
+
+	_, err := svc.StreamingCall(context.Background(), []entity.Message{{Role: "user", Content: "hi"}}, service.GenerateParams{}, &eventRecorder{}, service.LLMResult{})
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("err = %v, want the upstream error", err)
+	}
+}
@@ -1,7 +1,6 @@
 package llm
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -11,7 +10,7 @@ import (
 	"kepatrick/llm-playground/internal/domain/entity"
 	"kepatrick/llm-playground/internal/domain/service"
 	"net/http"
-	"os/exec"
+	"slices"
 	"strings" // String manipulation
 	"time"    // Time utilities
 
@@ -21,13 +20,65 @@ import (
 // maxToolCallDepth defines the maximum recursion depth for tool calls
 const maxToolCallDepth = 5
 
+// errToolCallDepth is returned once a turn exceeds maxToolCallDepth
+var errToolCallDepth = fmt.Errorf("tool call depth exceeded")
+
 // FunctionCall represents a function call with ID, name, and arguments
 type FunctionCall struct {
+	Index     int             // Position of the call among the parallel calls of a turn
 	ID        string          // Unique identifier for the function call
 	Name      string          // Name of the function
 	Arguments strings.Builder // Arguments for the function call
 }
 
+// openAIChunk is one chunk of the chat completions stream
+type openAIChunk struct {
+	Choices []struct {
+		Index        int         `json:"index"`
+		Delta        openAIDelta `json:"delta"`
+		FinishReason string      `json:"finish_reason"`
+		// ContentFilterResults is sent by Azure OpenAI along the answer
+		ContentFilterResults contentFilterResults `json:"content_filter_results"`
+	} `json:"choices"`
+	// PromptFilterResults is sent by Azure OpenAI in a first chunk without choices
+	PromptFilterResults []struct {
+		ContentFilterResults contentFilterResults `json:"content_filter_results"`
+	} `json:"prompt_filter_results"`
+	// Usage is only set on the final chunk, whose choices are empty
+	Usage *struct {
+		PromptTokens            int `json:"prompt_tokens"`
+		CompletionTokens        int `json:"completion_tokens"`
+		CompletionTokensDetails struct {
+			ReasoningTokens int `json:"reasoning_tokens"`
+		} `json:"completion_tokens_details"`
+		PromptTokensDetails struct {
+			CachedTokens int `json:"cached_tokens"`
+		} `json:"prompt_tokens_details"`
+		PromptCacheHitTokens int `json:"prompt_cache_hit_tokens"` // DeepSeek
+	} `json:"usage"`
+	// Error is sent by some compatible apis when they fail mid-stream
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// openAIDelta is the incremental message of a chunk choice
+type openAIDelta struct {
+	Role             string `json:"role"`
+	Content          string `json:"content"`
+	ReasoningContent string `json:"reasoning_content"` // DeepSeek reasoner and compatible apis
+	ToolCalls        []struct {
+		Index    *int   `json:"index"`
+		ID       string `json:"id"`
+		Type     string `json:"type"`
+		Function struct {
+			Name      string `json:"name"`
+			Arguments string `json:"arguments"`
+		} `json:"function"`
+	} `json:"tool_calls"`
+}
+
 // OpenAILLMService handles interactions with the OpenAI API
 type OpenAILLMService struct {
 	apiKey string       // API key for authentication
@@ -35,28 +86,35 @@ type OpenAILLMService struct {
 	model  string       // model
 	client *http.Client // HTTP client for making requests
 	tools  []config.Tool
+	// includeUsage asks for the final usage chunk, for apis that only send it on request
+	includeUsage bool
+	authScheme   string // how the key is sent, one of the Auth constants
 }
 
 // NewOpenAILLMService creates a new instance of OpenAILLMService
-func NewOpenAILLMService(key, url, model string, cli *http.Client, tools []config.Tool) *OpenAILLMService {
-	return &OpenAILLMService{key, url, model, cli, tools}
+func NewOpenAILLMService(key, url, model string, cli *http.Client, tools []config.Tool, includeUsage bool, authScheme string) *OpenAILLMService {
+	return &OpenAILLMService{key, url, model, cli, tools, includeUsage, authScheme}
 }
 
-func (s *OpenAILLMService) StreamingCall(ctx context.Context, messages []entity.Message, writer service.StreamWriter, lastRslt service.LLMResult) (service.LLMResult, error) {
+func (s *OpenAILLMService) StreamingCall(ctx context.Context, messages []entity.Message, params service.GenerateParams, writer service.StreamWriter, lastRslt service.LLMResult) (service.LLMResult, error) {
 	var builder strings.Builder
+	var reasoning strings.Builder
 	var curReqToken int
 	var curResToken int
+	var reasoningToken int
+	var cachedToken int
+	var finishReason string
+	var filtered []string // content filter categories flagged by Azure
 
 	depth := lastRslt.ToolCallDepth + 1
 	reqTokens := lastRslt.ReqToken
 	resTokens := lastRslt.ResToken
 
-	// needFunctionCall := false
 	// functionCalls slice
 	functionCalls := []*FunctionCall{}
 
 	if depth > maxToolCallDepth {
-		return buildLLMRslt("tool calling out of limit", false, depth, reqTokens, resTokens, nil), fmt.Errorf("tool call depth exceeded")
+		return buildLLMRslt("tool calling out of limit", false, depth, reqTokens, resTokens, nil), errToolCallDepth
 	}
 	// Build messages from session and prompt
 	msgs, err := s.buildMessages(messages)
@@ -64,25 +122,23 @@ func (s *OpenAILLMService) StreamingCall(ctx context.Context, messages []entity.
 		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), fmt.Errorf("build message failed")
 	}
 
-	tools := s.prepareReqTools(s.tools)
+	tools := offeredTools(s.tools, params)
 
 	// Prepare request body with streaming enabled
 	body := map[string]interface{}{
 		"model":    s.model,
 		"messages": msgs,
 		"stream":   true,
-		"tools":    tools,
 	}
+	if len(tools) > 0 {
+		body["tools"] = prepareReqTools(tools)
+	}
+	setOpenAIParams(body, params)
 
-	// if (strings.Contains(s.apiUrl, "openai")) {
-	// 	body = map[string]interface{}{
-	// 	"model":    s.model,
-	// 	"stream_options": map[string]bool{"include_usage": true},
-	// 	"messages": msgs,
-	// 	"stream":   true,
-	// 	"tools":    tools,
-	// 	}
-	// }
+	// Usage then arrives in a last chunk with empty choices, right before [DONE]
+	if s.includeUsage {
+		body["stream_options"] = map[string]bool{"include_usage": true}
+	}
 	data, err := json.Marshal(body)
 
 	if err != nil {
@@ -93,7 +149,7 @@ func (s *OpenAILLMService) StreamingCall(ctx context.Context, messages []entity.
 
 	// Create HTTP request
 	req, _ := http.NewRequestWithContext(ctx, "POST", s.apiUrl, bytes.NewBuffer(data))
-	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	setAuth(req, s.authScheme, s.apiKey)
 	req.Header.Set("Content-Type", "application/json")
 
 	// Execute request
@@ -105,131 +161,137 @@ func (s *OpenAILLMService) StreamingCall(ctx context.Context, messages []entity.
 
 	// Check http status
 	if res.StatusCode != http.StatusOK {
-		b, _ := io.ReadAll(res.Body)
-		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), fmt.Errorf("stream upstream error %d: %s", res.StatusCode, string(b))
+		return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), newUpstreamError(res)
 	}
 
 	// Read response stream
-	rd := bufio.NewReader(res.Body)
+	rd := newSSEReader(res.Body)
 	for {
-		// Read line from stream
-		line, err := rd.ReadString('\n')
+		evt, err := rd.Next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), err
 		}
 
-		// Skip non-data lines
-		if !strings.HasPrefix(line, "data: ") {
-			continue
+		if evt.Data == "[DONE]" {
+			break
 		}
 
-		// Process chunk
-		chunk := strings.TrimPrefix(strings.TrimSpace(line), "data: ")
-		if chunk == "[DONE]" {
-			if len(functionCalls) > 0 {
-				for _, fc := range functionCalls {
-					var resStr string
-					for _, tool := range s.tools {
-						if tool.Function.Name == fc.Name {
-							resStr, err = callTool(tool, fc)
-							if err != nil {
-								resStr = "fail to call tool"
-							}
-						}
-					}
-
-					if err != nil {
-						return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), err
-					}
-					// Add toolCall message to messages slice
-					messages = append(messages, entity.Message{
-						Role:       "assistant",
-						Content:    "",    // No content if functionCall
-						ToolCallID: fc.ID, // function call id
-						ToolCalls: []map[string]interface{}{{
-							"id":   fc.ID,
-							"type": "function",
-							"function": map[string]interface{}{
-								"name":      fc.Name,
-								"arguments": fc.Arguments.String(),
-							},
-						}},
-						Timestamp: nowMilli(),
-					})
-					// Add toolCall result to messages slice
-					messages = append(messages, entity.Message{
-						Role:       "tool",
-						Content:    resStr,
-						ToolCallID: fc.ID,
-						ToolCalls:  nil,
-						Timestamp:  nowMilli(),
-					})
-
-				}
-				// return with toolcall
-				return buildLLMRslt("", true, depth, reqTokens, resTokens, messages), err
-
-			}
-			writer.Done()
-			break
+		// Parse chunk
+		var chunk openAIChunk
+		if err := json.Unmarshal([]byte(evt.Data), &chunk); err != nil {
+			return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), &StreamFormatError{Provider: ProviderOpenAI, Frame: evt.Data, Err: err}
+		}
+		if chunk.Error != nil {
+			return buildLLMRslt("", false, depth, reqTokens, resTokens, nil), fmt.Errorf("stream upstream error %s: %s", chunk.Error.Type, chunk.Error.Message)
 		}
 
-		// Parse event
-		var event map[string]interface{}
-		json.Unmarshal([]byte(chunk), &event)
+		if chunk.Usage != nil {
+			curReqToken = chunk.Usage.PromptTokens
+			curResToken = chunk.Usage.CompletionTokens
+			reasoningToken = chunk.Usage.CompletionTokensDetails.ReasoningTokens
+			cachedToken = max(chunk.Usage.PromptTokensDetails.CachedTokens, chunk.Usage.PromptCacheHitTokens)
+		}
 
-		if usage, ok := event["usage"].(map[string]interface{}); ok && usage != nil {
-			if promptTokens, ok := usage["prompt_tokens"].(float64); ok {
-				curReqToken = int(promptTokens)
-			}
-			if completionTokens, ok := usage["completion_tokens"].(float64); ok {
-				curResToken = int(completionTokens)
-			}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].FinishReason != "" {
+			finishReason = chunk.Choices[0].FinishReason
+		}
+		for _, p := range chunk.PromptFilterResults {
+			filtered = append(filtered, p.ContentFilterResults.flagged("prompt ")...)
+		}
+		if len(chunk.Choices) > 0 {
+			filtered = append(filtered, chunk.Choices[0].ContentFilterResults.flagged("")...)
 		}
 
 		// Handle tool call
-		_, functionCalls = parseToolCall(event, functionCalls)
+		functionCalls = parseToolCall(chunk, functionCalls, writer)
+
+		// Reasoning streams ahead of the answer on its own channel
+		if r := extractReasoning(chunk); r != "" {
+			reasoning.WriteString(r)
+			writer.Send(service.ReasoningEvent(r))
+		}
 
 		// Write content to stream
-		content := extractContent(event)
-		if content != "" {
+		if content := extractContent(chunk); content != "" {
 			builder.WriteString(content)
-			writer.Write(content)
-			// Append generate result when \n\n
-			if strings.HasSuffix(content, "\n\n") {
-				messages = append(messages, entity.Message{
-					Role:       "assistant",
-					Content:    builder.String(),
-					ToolCallID: "",
-					ToolCalls:  nil,
-					Timestamp:  nowMilli(),
-				})
-				builder.Reset()
-			}
+			writer.Send(service.TokenEvent(content))
 		}
 	}
 	reqTokens += curReqToken
 	resTokens += curResToken
-	depth++
 
-	// Flush if builder has remain message
-	if rem := builder.String(); rem != "" {
-		writer.Write(rem)
+	// Azure may flag the answer without a content_filter finish reason of its own
+	if len(filtered) > 0 {
+		slices.Sort(filtered)
+		fmt.Printf("content filter flagged %s\n", strings.Join(slices.Compact(filtered), ", "))
+		finishReason = service.FinishContentFilter
+	}
+
+	if len(functionCalls) > 0 {
+		messages = appendToolCallMessages(ctx, messages, builder.String(), reasoning.String(), tools, functionCalls, writer)
+		// return with toolcall
+		rslt := buildLLMRslt("", true, depth, reqTokens, resTokens, messages)
+		rslt.ReasoningToken = reasoningToken
+		rslt.CachedToken = cachedToken
+		rslt.FinishReason = service.FinishToolCalls
+		return rslt, nil
+	}
+
+	if builder.Len() > 0 || reasoning.Len() > 0 {
 		messages = append(messages, entity.Message{
-			Role:       "assistant",
-			Content:    rem,
-			ToolCallID: "",
-			ToolCalls:  nil,
-			Timestamp:  nowMilli(),
+			Role:             "assistant",
+			Content:          builder.String(),
+			ReasoningContent: reasoning.String(),
+			Timestamp:        nowMilli(),
 		})
 	}
 
-	return buildLLMRslt(builder.String(), false, depth, reqTokens, resTokens, messages), err
+	rslt := buildLLMRslt(builder.String(), false, depth, reqTokens, resTokens, messages)
+	rslt.ReasoningToken = reasoningToken
+	rslt.CachedToken = cachedToken
+	rslt.FinishReason = finishReason
+	return rslt, nil
+}
+
+// setOpenAIParams copies the sampling parameters that were set into the request body
+func setOpenAIParams(body map[string]interface{}, p service.GenerateParams) {
+	if p.Temperature != nil {
+		body["temperature"] = *p.Temperature
+	}
+	if p.TopP != nil {
+		body["top_p"] = *p.TopP
+	}
+	if p.MaxTokens != nil {
+		body["max_tokens"] = *p.MaxTokens
+	}
+	if len(p.Stop) > 0 {
+		body["stop"] = p.Stop
+	}
+	if p.Seed != nil {
+		body["seed"] = *p.Seed
+	}
+	if p.PresencePenalty != nil {
+		body["presence_penalty"] = *p.PresencePenalty
+	}
+	if p.FrequencyPenalty != nil {
+		body["frequency_penalty"] = *p.FrequencyPenalty
+	}
+	if f := p.ResponseFormat; f != nil {
+		if f.Type == "json_schema" {
+			body["response_format"] = map[string]interface{}{
+				"type":        "json_schema",
+				"json_schema": map[string]interface{}{"name": f.Name, "schema": f.Schema},
+			}
+		} else {
+			body["response_format"] = map[string]interface{}{"type": "json_object"}
+		}
+	}
 }
 
-// buildMessages constructs the message array for API requests
+// buildMessages constructs the message array for API requests. Reasoning is
+// left out, reasoner apis reject reasoning_content in input messages.
 func (s *OpenAILLMService) buildMessages(raw []entity.Message) ([]map[string]interface{}, error) {
 
 	var msgs []map[string]interface{}
@@ -238,6 +300,9 @@ func (s *OpenAILLMService) buildMessages(raw []entity.Message) ([]map[string]int
 			"role":    m.Role,
 			"content": m.Content,
 		}
+		if len(m.Parts) > 0 {
+			entry["content"] = buildContentParts(m.Parts)
+		}
 		if m.ToolCallID != "" {
 			entry["tool_call_id"] = m.ToolCallID
 		}
@@ -250,57 +315,111 @@ func (s *OpenAILLMService) buildMessages(raw []entity.Message) ([]map[string]int
 	return msgs, nil
 }
 
-// Clear scripts for api request
-func (s *OpenAILLMService) prepareReqTools(tools []config.Tool) []config.Tool {
-
-	// make return slice
-	results := make([]config.Tool, len(tools))
-	copy(results, tools)
-	for i := range results {
-		results[i].Script = ""
+// buildContentParts converts multimodal parts into an OpenAI content array,
+// base64 images are sent as data URLs
+func buildContentParts(parts []entity.ContentPart) []map[string]interface{} {
+	var content []map[string]interface{}
+	for _, p := range parts {
+		switch p.Type {
+		case entity.PartText:
+			content = append(content, map[string]interface{}{"type": "text", "text": p.Text})
+		case entity.PartImageURL:
+			content = append(content, map[string]interface{}{
+				"type":      "image_url",
+				"image_url": map[string]interface{}{"url": p.URL},
+			})
+		case entity.PartImage:
+			content = append(content, map[string]interface{}{
+				"type":      "image_url",
+				"image_url": map[string]interface{}{"url": "data:" + p.MediaType + ";base64," + p.Data},
+			})
+		}
 	}
-	return results
+	return content
 }
 
-// parseToolCall checks if the event contains a tool call
-func parseToolCall(evt map[string]interface{}, fcs []*FunctionCall) (bool, []*FunctionCall) {
-	chs, ok := evt["choices"].([]interface{})
-	if !ok || len(chs) == 0 {
-		return false, nil
-	}
-	delta, ok := chs[0].(map[string]interface{})["delta"].(map[string]interface{})
-	if !ok {
-		return false, nil
+// parseToolCall accumulates the tool call fragments of the chunk. Parallel
+// calls are told apart by their index: the first fragment of a call carries
+// its id and name, later ones only extend the arguments. Both are forwarded
+// to the writer as tool call events.
+func parseToolCall(chunk openAIChunk, fcs []*FunctionCall, writer service.StreamWriter) []*FunctionCall {
+	if len(chunk.Choices) == 0 {
+		return fcs
 	}
-	if tcs, ok := delta["tool_calls"].([]interface{}); ok && len(tcs) > 0 {
-		raw := tcs[0].(map[string]interface{})
-		fn := raw["function"].(map[string]interface{})
-		id, _ := raw["id"].(string)
-		name, _ := fn["name"].(string)
-		args, _ := fn["arguments"].(string)
-		if name != "" {
-			fcs = append(fcs, &FunctionCall{ID: id, Name: name})
-		} else {
-			fcs[len(fcs)-1].Arguments.WriteString(args)
+	for i, tc := range chunk.Choices[0].Delta.ToolCalls {
+		idx := i
+		if tc.Index != nil {
+			idx = *tc.Index
+		}
+
+		var fc *FunctionCall
+		for _, c := range fcs {
+			if c.Index == idx {
+				fc = c
+				break
+			}
+		}
+		isNew := fc == nil
+		if isNew {
+			fc = &FunctionCall{Index: idx}
+			fcs = append(fcs, fc)
+		}
+
+		if tc.ID != "" {
+			fc.ID = tc.ID
+		}
+		if tc.Function.Name != "" {
+			fc.Name = tc.Function.Name
+		}
+		if isNew {
+			writer.Send(service.ToolCallStartEvent(fc.ID, fc.Index, fc.Name))
+		}
+		if tc.Function.Arguments != "" {
+			fc.Arguments.WriteString(tc.Function.Arguments)
+			writer.Send(service.ToolCallArgsEvent(fc.ID, fc.Index, tc.Function.Arguments))
 		}
 	}
-	return false, fcs
+	return fcs
 }
 
 // extractContent from delta.content
-func extractContent(evt map[string]interface{}) string {
-	chs, ok := evt["choices"].([]interface{})
-	if !ok || len(chs) == 0 {
+func extractContent(chunk openAIChunk) string {
+	if len(chunk.Choices) == 0 {
 		return ""
 	}
-	delta, ok := chs[0].(map[string]interface{})["delta"].(map[string]interface{})
-	if !ok {
+	return chunk.Choices[0].Delta.Content
+}
+
+// contentFilterResults are the Azure content filter categories of a prompt or
+// an answer. Categories are decoded one by one, their shapes differ between
+// api versions and only the filtered flag matters here.
+type contentFilterResults map[string]json.RawMessage
+
+// flagged returns the filtered categories with their severity, prefixed
+func (r contentFilterResults) flagged(prefix string) []string {
+	var names []string
+	for name, raw := range r {
+		var category struct {
+			Filtered bool   `json:"filtered"`
+			Severity string `json:"severity"`
+		}
+		if json.Unmarshal(raw, &category) != nil || !category.Filtered {
+			continue
+		}
+		if category.Severity != "" {
+			name += " (" + category.Severity + ")"
+		}
+		names = append(names, prefix+name)
+	}
+	return names
+}
+
+// extractReasoning returns the reasoning delta of the chunk
+func extractReasoning(chunk openAIChunk) string {
+	if len(chunk.Choices) == 0 {
 		return ""
 	}
-	content, _ := delta["content"].(string)
-	// somehow \n just cant work on javascript
-	content = strings.ReplaceAll(content, "\n", "[NEWLINE]")
-	return content
+	return chunk.Choices[0].Delta.ReasoningContent
 }
 
 // nowMilli returns the current time in milliseconds as a string
@@ -308,33 +427,6 @@ func nowMilli() string {
 	return fmt.Sprintf("%d", time.Now().UnixMilli())
 }
 
-func callTool(tool config.Tool, fc *FunctionCall) (string, error) {
-	script := "./scripts/" + tool.Script
-
-	fmt.Printf("tool: %s", tool.Function.Name)
-	fmt.Printf("\nscrpit:%s", tool.Script)
-
-	var args map[string]string
-	err := json.Unmarshal([]byte(fc.Arguments.String()), &args)
-	if err != nil {
-		return "", fmt.Errorf("fail to parse arguments to map: %w", err)
-	}
-
-	var cmdArgs []string
-	for k, v := range args {
-		cmdArgs = append(cmdArgs, "--"+k, v)
-	}
-
-	cmd := exec.Command(script, cmdArgs...)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("execution failed: %w\nOutput: %s", err, output)
-	}
-
-	return string(output), nil
-}
-
 func buildLLMRslt(res string, isToolCall bool, depth int, reqTokens int, resToken int, messages []entity.Message) service.LLMResult {
 	return service.LLMResult{
 		LlmRes:        res,
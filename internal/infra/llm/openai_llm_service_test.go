@@ -0,0 +1,92 @@
+package llm
+
+import (
+	"encoding/json"
+	"kepatrick/llm-playground/internal/domain/service"
+	"testing"
+)
+
+func TestParseToolCall(t *testing.T) {
+	type call struct {
+		index          int
+		id, name, args string
+	}
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []call
+		starts int
+	}{
+		{
+			name: "fragments of one call",
+			chunks: []string{
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"ci"}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"ty\":\"Paris\"}"}}]}}]}`,
+			},
+			want:   []call{{0, "call_1", "get_weather", `{"city":"Paris"}`}},
+			starts: 1,
+		},
+		{
+			name: "parallel calls interleaved by index",
+			chunks: []string{
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"name":"a","arguments":"{\"x\":"}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":1,"id":"call_2","function":{"name":"b","arguments":"{\"y\":"}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"1}"}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":1,"function":{"arguments":"2}"}}]}}]}`,
+			},
+			want:   []call{{0, "call_1", "a", `{"x":1}`}, {1, "call_2", "b", `{"y":2}`}},
+			starts: 2,
+		},
+		{
+			name: "several calls in one chunk",
+			chunks: []string{
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"name":"a","arguments":"{}"}},{"index":1,"id":"call_2","function":{"name":"b","arguments":"{}"}}]}}]}`,
+			},
+			want:   []call{{0, "call_1", "a", `{}`}, {1, "call_2", "b", `{}`}},
+			starts: 2,
+		},
+		{
+			name: "missing index falls back to the position in the chunk",
+			chunks: []string{
+				`{"choices":[{"delta":{"tool_calls":[{"id":"call_1","function":{"name":"a","arguments":"{}"}},{"id":"call_2","function":{"name":"b","arguments":"{}"}}]}}]}`,
+			},
+			want:   []call{{0, "call_1", "a", `{}`}, {1, "call_2", "b", `{}`}},
+			starts: 2,
+		},
+		{
+			name: "chunks without choices or calls",
+			chunks: []string{
+				`{"choices":[]}`,
+				`{"choices":[{"delta":{"content":"hi"}}]}`,
+			},
+			starts: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &eventRecorder{}
+			var fcs []*FunctionCall
+			for _, c := range tt.chunks {
+				var chunk openAIChunk
+				if err := json.Unmarshal([]byte(c), &chunk); err != nil {
+					t.Fatalf("chunk %s: %v", c, err)
+				}
+				fcs = parseToolCall(chunk, fcs, w)
+			}
+
+			if len(fcs) != len(tt.want) {
+				t.Fatalf("got %d calls, want %d", len(fcs), len(tt.want))
+			}
+			for i, fc := range fcs {
+				got := call{fc.Index, fc.ID, fc.Name, fc.Arguments.String()}
+				if got != tt.want[i] {
+					t.Errorf("call %d = %+v, want %+v", i, got, tt.want[i])
+				}
+			}
+			if n := w.count(service.EventToolCallStart); n != tt.starts {
+				t.Errorf("got %d tool call start events, want %d", n, tt.starts)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package llm
+
+import (
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/service"
+	"log"
+	"net/http"
+)
+
+// Supported values of the provider field in configs/api.json
+const (
+	ProviderOpenAI    = "openai"
+	ProviderAzure     = "azure" // Azure OpenAI deployments
+	ProviderAnthropic = "anthropic"
+	ProviderOllama    = "ollama"
+	ProviderGemini    = "gemini"
+)
+
+// NewLLMService creates the LLMService matching the provider of the api config,
+// an empty provider means an OpenAI compatible api. The limiter keeps the
+// calls of the api named name within its rate limit.
+func NewLLMService(name string, cfg config.ApiConfig, cli *http.Client, tools []config.Tool, limiter service.RateLimiter) service.LLMService {
+	switch cfg.AuthScheme {
+	case "", AuthBearer, AuthApiKey, AuthNone:
+	default:
+		log.Fatalf("unknown auth scheme of api %s: %s", name, cfg.AuthScheme)
+	}
+	cli = withRequestOptions(cli, cfg.Headers, cfg.Query)
+
+	var svc service.LLMService
+	switch cfg.Provider {
+	case "", ProviderOpenAI:
+		svc = NewOpenAILLMService(cfg.ApiKey, cfg.ApiUrl, cfg.Model, cli, tools, cfg.IncludeUsage, cfg.AuthScheme)
+	case ProviderAzure:
+		deployment := cfg.Deployment
+		if deployment == "" {
+			deployment = cfg.Model
+		}
+		url, err := azureChatURL(cfg.ApiUrl, deployment, cfg.ApiVersion)
+		if err != nil {
+			log.Fatalf("invalid azure api %s: %v", name, err)
+		}
+		auth := cfg.AuthScheme
+		if auth == "" {
+			auth = AuthApiKey
+		}
+		svc = NewOpenAILLMService(cfg.ApiKey, url, cfg.Model, cli, tools, cfg.IncludeUsage, auth)
+	case ProviderAnthropic:
+		svc = NewAnthropicLLMService(cfg.ApiKey, cfg.ApiUrl, cfg.Model, cli, tools)
+	case ProviderOllama:
+		svc = NewOllamaLLMService(cfg.ApiKey, cfg.ApiUrl, cfg.Model, cli, tools)
+	case ProviderGemini:
+		svc = NewGeminiLLMService(cfg.ApiKey, cfg.ApiUrl, cfg.Model, cli, tools)
+	default:
+		log.Fatalf("unknown llm provider: %s", cfg.Provider)
+	}
+
+	svc = NewUsageEstimateLLMService(svc)
+	if cfg.RateLimit.Rpm > 0 || cfg.RateLimit.Tpm > 0 {
+		svc = NewRateLimitLLMService(name, svc, cfg.RateLimit, limiter)
+	}
+	if cfg.Retry.MaxAttempts > 1 {
+		svc = NewRetryLLMService(svc, cfg.Retry)
+	}
+	return svc
+}
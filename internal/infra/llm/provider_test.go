@@ -0,0 +1,165 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// eventRecorder is a StreamWriter keeping every event it is sent
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []service.StreamEvent
+}
+
+func (w *eventRecorder) Send(event service.StreamEvent) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.events = append(w.events, event)
+	return nil
+}
+
+// count returns how many events of the type were sent
+func (w *eventRecorder) count(eventType string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := 0
+	for _, e := range w.events {
+		if e.Type == eventType {
+			n++
+		}
+	}
+	return n
+}
+
+// replayServer answers every request with the recorded stream body, the body
+// of the last request is kept for the test to inspect
+func replayServer(t *testing.T, contentType, stream string) (*httptest.Server, *[]byte) {
+	t.Helper()
+	var reqBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", contentType)
+		io.WriteString(w, stream)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &reqBody
+}
+
+// toolCallOf returns the name and arguments of a tool call of an assistant message
+func toolCallOf(tc map[string]interface{}) (id, name, args string) {
+	fn, _ := tc["function"].(map[string]interface{})
+	id, _ = tc["id"].(string)
+	name, _ = fn["name"].(string)
+	args, _ = fn["arguments"].(string)
+	return id, name, args
+}
+
+func TestNoToolsLeavesToolsOut(t *testing.T) {
+	tools := []config.Tool{{Type: "function", Function: config.Function{Name: "get_weather"}, Script: "get_weather.sh"}}
+	openAIStream := "data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n"
+	tests := []struct {
+		name        string
+		contentType string
+		stream      string
+		svc         func(url string) service.LLMService
+	}{
+		{"openai", "text/event-stream", openAIStream, func(url string) service.LLMService {
+			return NewOpenAILLMService("", url, "gpt-4o", http.DefaultClient, tools, false, "")
+		}},
+		{"anthropic", "text/event-stream", anthropicStream, func(url string) service.LLMService {
+			return NewAnthropicLLMService("", url, "claude", http.DefaultClient, tools)
+		}},
+		{"gemini", "text/event-stream", geminiStream, func(url string) service.LLMService {
+			return NewGeminiLLMService("", url, "gemini", http.DefaultClient, tools)
+		}},
+		{"ollama", "application/x-ndjson", ollamaStream, func(url string) service.LLMService {
+			return NewOllamaLLMService("", url, "qwen3", http.DefaultClient, tools)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, noTools := range []bool{false, true} {
+				srv, reqBody := replayServer(t, tt.contentType, tt.stream)
+				params := service.GenerateParams{NoTools: noTools}
+				_, err := tt.svc(srv.URL).StreamingCall(context.Background(), []entity.Message{{Role: "user", Content: "hi"}}, params, &eventRecorder{}, service.LLMResult{})
+				if err != nil {
+					t.Fatalf("StreamingCall: %v", err)
+				}
+				var body map[string]interface{}
+				if err := json.Unmarshal(*reqBody, &body); err != nil {
+					t.Fatalf("request body: %v", err)
+				}
+				if _, sent := body["tools"]; sent == noTools {
+					t.Errorf("NoTools = %v, tools sent = %v", noTools, sent)
+				}
+			}
+		})
+	}
+}
+
+func TestImageParts(t *testing.T) {
+	image := entity.ContentPart{Type: entity.PartImage, MediaType: "image/png", Data: "iVBORw0KGgo="}
+	imageURL := entity.ContentPart{Type: entity.PartImageURL, URL: "https://example.com/cat.png"}
+	text := entity.ContentPart{Type: entity.PartText, Text: "What is this?"}
+	tests := []struct {
+		name        string
+		contentType string
+		stream      string
+		svc         func(url string) service.LLMService
+		part        entity.ContentPart
+		want        string // JSON the request body must contain, empty when the part is refused
+	}{
+		{"anthropic base64", "text/event-stream", anthropicStream, func(url string) service.LLMService {
+			return NewAnthropicLLMService("", url, "claude", http.DefaultClient, nil)
+		}, image, `"content":[{"text":"What is this?","type":"text"},{"source":{"data":"iVBORw0KGgo=","media_type":"image/png","type":"base64"},"type":"image"}]`},
+		{"anthropic url", "text/event-stream", anthropicStream, func(url string) service.LLMService {
+			return NewAnthropicLLMService("", url, "claude", http.DefaultClient, nil)
+		}, imageURL, `{"source":{"type":"url","url":"https://example.com/cat.png"},"type":"image"}`},
+		{"gemini inlineData", "text/event-stream", geminiStream, func(url string) service.LLMService {
+			return NewGeminiLLMService("", url, "gemini", http.DefaultClient, nil)
+		}, image, `"parts":[{"text":"What is this?"},{"inlineData":{"data":"iVBORw0KGgo=","mimeType":"image/png"}}]`},
+		{"gemini url", "text/event-stream", geminiStream, func(url string) service.LLMService {
+			return NewGeminiLLMService("", url, "gemini", http.DefaultClient, nil)
+		}, imageURL, ""},
+		{"ollama images", "application/x-ndjson", ollamaStream, func(url string) service.LLMService {
+			return NewOllamaLLMService("", url, "qwen3", http.DefaultClient, nil)
+		}, image, `{"content":"What is this?","images":["iVBORw0KGgo="],"role":"user"}`},
+		{"ollama url", "application/x-ndjson", ollamaStream, func(url string) service.LLMService {
+			return NewOllamaLLMService("", url, "qwen3", http.DefaultClient, nil)
+		}, imageURL, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, reqBody := replayServer(t, tt.contentType, tt.stream)
+			msgs := []entity.Message{{Role: "user", Content: "What is this?", Parts: []entity.ContentPart{text, tt.part}}}
+			_, err := tt.svc(srv.URL).StreamingCall(context.Background(), msgs, service.GenerateParams{}, &eventRecorder{}, service.LLMResult{})
+			if tt.want == "" {
+				if !errors.Is(err, service.ErrUnsupportedInput) {
+					t.Errorf("err = %v, want ErrUnsupportedInput", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("StreamingCall: %v", err)
+			}
+			// re-encode so map keys are sorted
+			var body interface{}
+			json.Unmarshal(*reqBody, &body)
+			sorted, _ := json.Marshal(body)
+			if !strings.Contains(string(sorted), tt.want) {
+				t.Errorf("request body %s misses %s", sorted, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"kepatrick/llm-playground/pkg/approxtoken"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RateLimitLLMService keeps the calls of an api within its requests and
+// tokens per minute. Prompt tokens are estimated and taken before the call,
+// the difference to the reported usage is settled afterwards.
+type RateLimitLLMService struct {
+	svc     service.LLMService
+	name    string
+	cfg     config.RateLimitConfig
+	limiter service.RateLimiter
+}
+
+// NewRateLimitLLMService creates a new instance of RateLimitLLMService
+func NewRateLimitLLMService(name string, svc service.LLMService, cfg config.RateLimitConfig, limiter service.RateLimiter) *RateLimitLLMService {
+	return &RateLimitLLMService{svc, name, cfg, limiter}
+}
+
+func (s *RateLimitLLMService) StreamingCall(ctx context.Context, messages []entity.Message, params service.GenerateParams, writer service.StreamWriter, lastRslt service.LLMResult) (service.LLMResult, error) {
+	maxWait := time.Duration(-1)
+	if s.cfg.Reject {
+		maxWait = 0
+	} else if s.cfg.MaxWaitMs > 0 {
+		maxWait = time.Duration(s.cfg.MaxWaitMs) * time.Millisecond
+	}
+
+	var wait time.Duration
+	if s.cfg.Rpm > 0 {
+		w, err := s.take(ctx, "rpm", 1, s.cfg.Rpm, maxWait)
+		if err != nil {
+			return lastRslt, err
+		}
+		wait = w
+	}
+	estimated := 0
+	if s.cfg.Tpm > 0 {
+		estimated = approxtoken.EstimateMessages(messages) + approxtoken.TokensPerReply
+		w, err := s.take(ctx, "tpm", estimated, s.cfg.Tpm, maxWait)
+		if err != nil {
+			if s.cfg.Rpm > 0 {
+				s.limiter.Take(ctx, s.name+":rpm", -1, s.cfg.Rpm, -1)
+			}
+			return lastRslt, err
+		}
+		wait = max(wait, w)
+	}
+
+	if wait > 0 {
+		fmt.Printf("api %s over its rate limit, wait %v\n", s.name, wait)
+		writer.Send(service.StatusEvent(fmt.Sprintf("rate limit of %s reached, waiting %.1fs", s.name, wait.Seconds())))
+		select {
+		case <-ctx.Done():
+			return lastRslt, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+
+	rslt, err := s.svc.StreamingCall(ctx, messages, params, writer, lastRslt)
+
+	// Settle the estimate with the tokens the call used, a failed call may have used none
+	if s.cfg.Tpm > 0 {
+		used := rslt.ReqToken - lastRslt.ReqToken + rslt.ResToken - lastRslt.ResToken
+		if err != nil && used <= 0 {
+			used = 0
+		}
+		if used != estimated {
+			if _, _, terr := s.limiter.Take(ctx, s.name+":tpm", used-estimated, s.cfg.Tpm, -1); terr != nil {
+				fmt.Printf("fail to settle tokens of %s: %v\n", s.name, terr)
+			}
+		}
+	}
+	return rslt, err
+}
+
+// take takes n from the named bucket of the api, or fails with ErrRateLimited
+// when the wait would exceed maxWait
+func (s *RateLimitLLMService) take(ctx context.Context, kind string, n, perMinute int, maxWait time.Duration) (time.Duration, error) {
+	wait, ok, err := s.limiter.Take(ctx, s.name+":"+kind, n, perMinute, maxWait)
+	if err != nil {
+		// A broken limiter must not take the api down with it
+		fmt.Printf("rate limiter of %s failed: %v\n", s.name, err)
+		return 0, nil
+	}
+	if !ok {
+		return 0, errors.Wrapf(service.ErrRateLimited, "api %s is over its %s limit of %d, retry in %.0fs", s.name, kind, perMinute, wait.Seconds()+0.5)
+	}
+	return wait, nil
+}
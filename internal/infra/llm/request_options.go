@@ -0,0 +1,92 @@
+package llm
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Values of the authScheme field in configs/api.json
+const (
+	AuthBearer = "bearer"  // Authorization: Bearer <key>
+	AuthApiKey = "api-key" // api-key: <key>, as Azure OpenAI expects
+	AuthNone   = "none"
+)
+
+// defaultAzureApiVersion is the GA api-version used when apiVersion is unset
+const defaultAzureApiVersion = "2024-10-21"
+
+// setAuth sets the key of the request as the auth scheme asks
+func setAuth(req *http.Request, scheme, key string) {
+	switch scheme {
+	case AuthApiKey:
+		req.Header.Set("api-key", key)
+	case AuthNone:
+	default:
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+}
+
+// azureChatURL returns the chat completions url of an Azure OpenAI deployment,
+// apiUrl is the resource endpoint such as https://<resource>.openai.azure.com.
+// A full deployment url is used as is, only the api-version is added if missing.
+func azureChatURL(apiUrl, deployment, apiVersion string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(apiUrl, "/"))
+	if err != nil {
+		return "", errors.Wrap(err, "parse azure apiUrl")
+	}
+	if !strings.Contains(u.Path, "/openai/deployments/") {
+		if deployment == "" {
+			return "", errors.New("azure api needs a deployment or model")
+		}
+		u.Path += "/openai/deployments/" + deployment + "/chat/completions"
+	}
+	if apiVersion == "" {
+		apiVersion = defaultAzureApiVersion
+	}
+	q := u.Query()
+	if q.Get("api-version") == "" {
+		q.Set("api-version", apiVersion)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// withRequestOptions returns a copy of the client adding the configured
+// headers and query parameters to every request
+func withRequestOptions(cli *http.Client, headers, query map[string]string) *http.Client {
+	if len(headers) == 0 && len(query) == 0 {
+		return cli
+	}
+	next := cli.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	c := *cli
+	c.Transport = &requestOptionsTransport{next: next, headers: headers, query: query}
+	return &c
+}
+
+type requestOptionsTransport struct {
+	next    http.RoundTripper
+	headers map[string]string
+	query   map[string]string
+}
+
+func (t *requestOptionsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	if len(t.query) > 0 {
+		q := req.URL.Query()
+		for k, v := range t.query {
+			q.Set(k, v)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+	return t.next.RoundTrip(req)
+}
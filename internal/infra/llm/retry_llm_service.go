@@ -0,0 +1,158 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// default delays of the retry policy, used when api.json leaves them out
+const (
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+// UpstreamError is returned when the upstream answers with a non 200 status
+type UpstreamError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // wait requested by Retry-After or x-ratelimit-reset headers, 0 if none
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("stream upstream error %d: %s", e.StatusCode, e.Body)
+}
+
+// Retryable reports whether the status is worth another attempt
+func (e *UpstreamError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// newUpstreamError reads the failed response into an UpstreamError
+func newUpstreamError(res *http.Response) *UpstreamError {
+	b, _ := io.ReadAll(res.Body)
+	return &UpstreamError{
+		StatusCode: res.StatusCode,
+		Body:       string(b),
+		RetryAfter: retryAfter(res.Header, time.Now()),
+	}
+}
+
+// retryAfter returns the longest wait asked for by the rate limit headers.
+// Retry-After holds seconds or an HTTP date, x-ratelimit-reset* hold either
+// durations ("6m0s"), seconds, or a unix timestamp depending on the provider.
+func retryAfter(h http.Header, now time.Time) time.Duration {
+	var wait time.Duration
+	for _, key := range []string{"Retry-After", "X-Ratelimit-Reset", "X-Ratelimit-Reset-Requests", "X-Ratelimit-Reset-Tokens"} {
+		v := h.Get(key)
+		if v == "" {
+			continue
+		}
+
+		var d time.Duration
+		if parsed, err := time.ParseDuration(v); err == nil {
+			d = parsed
+		} else if secs, err := strconv.ParseFloat(v, 64); err == nil {
+			if secs > 1e9 {
+				d = time.Unix(int64(secs), 0).Sub(now)
+			} else {
+				d = time.Duration(secs * float64(time.Second))
+			}
+		} else if t, err := http.ParseTime(v); err == nil {
+			d = t.Sub(now)
+		}
+
+		if d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// RetryLLMService retries a provider on 429, 5xx and network errors with
+// exponential backoff, as long as nothing was written to the stream yet
+type RetryLLMService struct {
+	svc    service.LLMService
+	policy config.RetryConfig
+}
+
+// NewRetryLLMService creates a new instance of RetryLLMService
+func NewRetryLLMService(svc service.LLMService, policy config.RetryConfig) *RetryLLMService {
+	if policy.BaseDelayMs <= 0 {
+		policy.BaseDelayMs = int(defaultRetryBaseDelay / time.Millisecond)
+	}
+	if policy.MaxDelayMs <= 0 {
+		policy.MaxDelayMs = int(defaultRetryMaxDelay / time.Millisecond)
+	}
+	return &RetryLLMService{svc, policy}
+}
+
+func (s *RetryLLMService) StreamingCall(ctx context.Context, messages []entity.Message, params service.GenerateParams, writer service.StreamWriter, lastRslt service.LLMResult) (service.LLMResult, error) {
+	var rslt service.LLMResult
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		w := &trackingWriter{StreamWriter: writer}
+		rslt, err = s.svc.StreamingCall(ctx, messages, params, w, lastRslt)
+		if err == nil || w.written || ctx.Err() != nil || attempt >= s.policy.MaxAttempts {
+			return rslt, err
+		}
+
+		delay, ok := s.backoff(err, attempt)
+		if !ok {
+			return rslt, err
+		}
+
+		fmt.Printf("retry attempt %d/%d in %v: %v\n", attempt+1, s.policy.MaxAttempts, delay, err)
+		writer.Send(service.StatusEvent(fmt.Sprintf("upstream busy, retry %d/%d in %.1fs", attempt+1, s.policy.MaxAttempts, delay.Seconds())))
+
+		select {
+		case <-ctx.Done():
+			return rslt, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns the wait before the next attempt, or false if err is not retryable.
+// The wait doubles per attempt with random jitter, unless the upstream asked for longer.
+// A wait asked for beyond MaxDelayMs is not retried, the upstream error is returned.
+func (s *RetryLLMService) backoff(err error, attempt int) (time.Duration, bool) {
+	var upErr *UpstreamError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &upErr):
+		if !upErr.Retryable() {
+			return 0, false
+		}
+	case errors.As(err, &netErr):
+	default:
+		return 0, false
+	}
+
+	maxDelay := time.Duration(s.policy.MaxDelayMs) * time.Millisecond
+	delay := time.Duration(s.policy.BaseDelayMs) * time.Millisecond << (attempt - 1)
+	if delay <= 0 || delay > maxDelay {
+		delay = maxDelay
+	}
+	if s.policy.Jitter > 0 {
+		delay += time.Duration(rand.Float64() * s.policy.Jitter * float64(delay))
+	}
+	if upErr != nil && upErr.RetryAfter > delay {
+		if upErr.RetryAfter > maxDelay {
+			return 0, false
+		}
+		delay = upErr.RetryAfter
+	}
+	return delay, true
+}
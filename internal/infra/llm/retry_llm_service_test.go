@@ -0,0 +1,38 @@
+package llm
+
+import (
+	"context"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/service"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfterCap(t *testing.T) {
+	policy := config.RetryConfig{MaxAttempts: 3, BaseDelayMs: 1, MaxDelayMs: 50}
+	tests := []struct {
+		name       string
+		retryAfter time.Duration
+		wantCalls  int
+	}{
+		{"no header", 0, 3},
+		{"within max delay", 20 * time.Millisecond, 3},
+		{"beyond max delay", time.Hour, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upErr := &UpstreamError{StatusCode: http.StatusTooManyRequests, RetryAfter: tt.retryAfter}
+			stub := &stubLLMService{err: upErr}
+			svc := NewRetryLLMService(stub, policy)
+
+			_, err := svc.StreamingCall(context.Background(), nil, service.GenerateParams{}, &eventRecorder{}, service.LLMResult{})
+			if err != upErr {
+				t.Errorf("err = %v, want the upstream error", err)
+			}
+			if stub.calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", stub.calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package llm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// sseEvent is one dispatched event of a text/event-stream
+type sseEvent struct {
+	Event string // value of the event: field, empty for the default "message"
+	ID    string
+	Data  string // data: fields of the event joined by "\n"
+}
+
+// sseReader reads events from a text/event-stream body
+type sseReader struct {
+	rd *bufio.Reader
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{bufio.NewReader(r)}
+}
+
+// Next returns the next event, or io.EOF once the stream is exhausted.
+// Comment lines are skipped, multi-line data fields are joined, and an event
+// not terminated by a blank line before EOF is still returned.
+func (r *sseReader) Next() (sseEvent, error) {
+	var evt sseEvent
+	var data []string
+	hasData := false
+
+	for {
+		line, err := r.rd.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return evt, err
+		}
+		eof := err == io.EOF
+		line = strings.TrimRight(line, "\r\n")
+
+		// A blank line dispatches the event collected so far
+		if line == "" {
+			if hasData {
+				evt.Data = strings.Join(data, "\n")
+				return evt, nil
+			}
+			if eof {
+				return evt, io.EOF
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(line, ":") {
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "data":
+				data = append(data, value)
+				hasData = true
+			case "event":
+				evt.Event = value
+			case "id":
+				evt.ID = value
+			}
+		}
+
+		if eof {
+			if hasData {
+				evt.Data = strings.Join(data, "\n")
+				return evt, nil
+			}
+			return evt, io.EOF
+		}
+	}
+}
+
+// StreamFormatError is returned when a frame of the upstream stream cannot be decoded
+type StreamFormatError struct {
+	Provider string
+	Frame    string
+	Err      error
+}
+
+func (e *StreamFormatError) Error() string {
+	return fmt.Sprintf("malformed %s stream frame %q: %v", e.Provider, e.Frame, e.Err)
+}
+
+func (e *StreamFormatError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,93 @@
+package llm
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSSEReaderNext(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []sseEvent
+	}{
+		{
+			name:   "single line data",
+			stream: "data: {\"a\":1}\n\ndata: [DONE]\n\n",
+			want:   []sseEvent{{Data: `{"a":1}`}, {Data: "[DONE]"}},
+		},
+		{
+			name:   "multi-line data is joined",
+			stream: "data: first\ndata: second\ndata:\ndata: fourth\n\n",
+			want:   []sseEvent{{Data: "first\nsecond\n\nfourth"}},
+		},
+		{
+			name:   "comments are skipped",
+			stream: ": keep-alive\n\n: OPENROUTER PROCESSING\ndata: x\n: inside an event\n\n",
+			want:   []sseEvent{{Data: "x"}},
+		},
+		{
+			name:   "id and event fields",
+			stream: "event: message_start\nid: 7\ndata: {}\n\nevent: ping\ndata: {\"type\":\"ping\"}\n\n",
+			want:   []sseEvent{{Event: "message_start", ID: "7", Data: "{}"}, {Event: "ping", Data: `{"type":"ping"}`}},
+		},
+		{
+			name:   "no space after the colon",
+			stream: "event:delta\ndata:x\n\n",
+			want:   []sseEvent{{Event: "delta", Data: "x"}},
+		},
+		{
+			name:   "only one leading space is removed",
+			stream: "data:  indented\n\n",
+			want:   []sseEvent{{Data: " indented"}},
+		},
+		{
+			name:   "CRLF line endings",
+			stream: "data: a\r\ndata: b\r\n\r\ndata: c\r\n\r\n",
+			want:   []sseEvent{{Data: "a\nb"}, {Data: "c"}},
+		},
+		{
+			name:   "unknown fields are ignored",
+			stream: "retry: 3000\nfoo: bar\ndata: x\n\n",
+			want:   []sseEvent{{Data: "x"}},
+		},
+		{
+			name:   "last event without a blank line",
+			stream: "data: a\n\ndata: b",
+			want:   []sseEvent{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:   "blank lines between events",
+			stream: "\n\n\ndata: a\n\n\n\ndata: b\n\n\n",
+			want:   []sseEvent{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:   "empty stream",
+			stream: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd := newSSEReader(strings.NewReader(tt.stream))
+			var got []sseEvent
+			for {
+				evt, err := rd.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Next: %v", err)
+				}
+				got = append(got, evt)
+				if len(got) > len(tt.want) {
+					break
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"os/exec"
+	"sync"
+)
+
+// maxParallelTools bounds how many tool scripts run at the same time
+const maxParallelTools = 4
+
+// offeredTools returns the tools a call may use, none when its params ask for none
+func offeredTools(tools []config.Tool, params service.GenerateParams) []config.Tool {
+	if params.NoTools {
+		return nil
+	}
+	return tools
+}
+
+// appendToolCallMessages appends one assistant message carrying every tool call
+// of the turn, as the APIs require, then runs the tools and appends one tool
+// message per call in the same order, each result is also sent to the writer
+func appendToolCallMessages(ctx context.Context, messages []entity.Message, content, reasoning string, tools []config.Tool, fcs []*FunctionCall, writer service.StreamWriter) []entity.Message {
+	toolCalls := make([]map[string]interface{}, 0, len(fcs))
+	for _, fc := range fcs {
+		// Calls without parameters may stream no argument fragment at all
+		if fc.Arguments.Len() == 0 {
+			fc.Arguments.WriteString("{}")
+		}
+		toolCalls = append(toolCalls, map[string]interface{}{
+			"id":   fc.ID,
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":      fc.Name,
+				"arguments": fc.Arguments.String(),
+			},
+		})
+	}
+	messages = append(messages, entity.Message{
+		Role:             "assistant",
+		Content:          content,
+		ReasoningContent: reasoning,
+		ToolCalls:        toolCalls,
+		Timestamp:        nowMilli(),
+	})
+
+	for i, resStr := range runToolCalls(ctx, tools, fcs) {
+		writer.Send(service.ToolResultEvent(fcs[i].ID, fcs[i].Name, resStr))
+		messages = append(messages, entity.Message{
+			Role:       "tool",
+			Content:    resStr,
+			ToolCallID: fcs[i].ID,
+			Timestamp:  nowMilli(),
+		})
+	}
+	return messages
+}
+
+// runToolCalls executes the function calls concurrently, bounded by
+// maxParallelTools, and returns their results in call order
+func runToolCalls(ctx context.Context, tools []config.Tool, fcs []*FunctionCall) []string {
+	results := make([]string, len(fcs))
+	sem := make(chan struct{}, maxParallelTools)
+
+	var wg sync.WaitGroup
+	for i, fc := range fcs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = invokeTool(ctx, tools, fc.Name, fc.Arguments.String())
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// invokeTool finds the tool by name and runs its script, returning the output
+// that should be sent back to the model as the tool result. Cancelling ctx
+// kills the running script.
+func invokeTool(ctx context.Context, tools []config.Tool, name, args string) string {
+	for _, tool := range tools {
+		if tool.Function.Name != name {
+			continue
+		}
+		resStr, err := callTool(ctx, tool, args)
+		if err != nil {
+			return "fail to call tool"
+		}
+		return resStr
+	}
+	return "fail to call tool"
+}
+
+func callTool(ctx context.Context, tool config.Tool, arguments string) (string, error) {
+	script := "./scripts/" + tool.Script
+
+	fmt.Printf("tool: %s", tool.Function.Name)
+	fmt.Printf("\nscrpit:%s", tool.Script)
+
+	var args map[string]string
+	err := json.Unmarshal([]byte(arguments), &args)
+	if err != nil {
+		return "", fmt.Errorf("fail to parse arguments to map: %w", err)
+	}
+
+	var cmdArgs []string
+	for k, v := range args {
+		cmdArgs = append(cmdArgs, "--"+k, v)
+	}
+
+	cmd := exec.CommandContext(ctx, script, cmdArgs...)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("execution failed: %w\nOutput: %s", err, output)
+	}
+
+	return string(output), nil
+}
+
+// Clear scripts for api request
+func prepareReqTools(tools []config.Tool) []config.Tool {
+
+	// make return slice
+	results := make([]config.Tool, len(tools))
+	copy(results, tools)
+	for i := range results {
+		results[i].Script = ""
+	}
+	return results
+}
@@ -0,0 +1,60 @@
+package llm
+
+import (
+	"context"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"kepatrick/llm-playground/pkg/approxtoken"
+)
+
+// UsageEstimateLLMService fills in estimated token counts for calls whose
+// provider reported no usage, and flags the result as estimated
+type UsageEstimateLLMService struct {
+	svc service.LLMService
+}
+
+// NewUsageEstimateLLMService creates a new instance of UsageEstimateLLMService
+func NewUsageEstimateLLMService(svc service.LLMService) *UsageEstimateLLMService {
+	return &UsageEstimateLLMService{svc}
+}
+
+func (s *UsageEstimateLLMService) StreamingCall(ctx context.Context, messages []entity.Message, params service.GenerateParams, writer service.StreamWriter, lastRslt service.LLMResult) (service.LLMResult, error) {
+	rslt, err := s.svc.StreamingCall(ctx, messages, params, writer, lastRslt)
+	rslt.TokenEstimated = lastRslt.TokenEstimated
+
+	// Providers report the reasoning and cache tokens of their own call, the turn total is kept here
+	callReasoning := rslt.ReasoningToken
+	rslt.ReasoningToken = lastRslt.ReasoningToken
+	callCached := rslt.CachedToken
+	rslt.CachedToken = lastRslt.CachedToken
+	callCacheWrite := rslt.CacheWriteToken
+	rslt.CacheWriteToken = lastRslt.CacheWriteToken
+	if err != nil || len(rslt.Messages) < len(messages) {
+		return rslt, err
+	}
+	rslt.CachedToken += callCached
+	rslt.CacheWriteToken += callCacheWrite
+
+	estimatedReasoning := 0
+	for _, m := range rslt.Messages[len(messages):] {
+		estimatedReasoning += approxtoken.Estimate(m.ReasoningContent)
+	}
+	if callReasoning == 0 && estimatedReasoning > 0 {
+		callReasoning = estimatedReasoning
+		rslt.TokenEstimated = true
+	}
+	rslt.ReasoningToken += callReasoning
+
+	if rslt.ReqToken == lastRslt.ReqToken && rslt.ResToken == lastRslt.ResToken {
+		rslt.ReqToken += approxtoken.EstimateMessages(messages) + approxtoken.TokensPerReply
+
+		// Tool results are input of the next call, only the assistant output counts here
+		for _, m := range rslt.Messages[len(messages):] {
+			if m.Role == "assistant" {
+				rslt.ResToken += approxtoken.EstimateMessage(m) + approxtoken.Estimate(m.ReasoningContent)
+			}
+		}
+		rslt.TokenEstimated = true
+	}
+	return rslt, nil
+}
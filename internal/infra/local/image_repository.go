@@ -0,0 +1,60 @@
+package local
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// image extension by media type
+var imageExts = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+type FileImageRepo struct {
+	BaseDir string // Base directory where images are stored, one folder per session
+}
+
+// Constructor for FileImageRepo
+func NewFileImageRepo(baseDir string) *FileImageRepo {
+	return &FileImageRepo{BaseDir: baseDir}
+}
+
+// Save writes the image under <BaseDir>/<sessionID>/ with a random name
+func (r *FileImageRepo) Save(ctx context.Context, sessionID, mediaType string, data []byte) (entity.ContentPart, error) {
+	ext, ok := imageExts[mediaType]
+	if !ok {
+		return entity.ContentPart{}, fmt.Errorf("unsupported image type %s", mediaType)
+	}
+
+	dir := filepath.Join(r.BaseDir, filepath.Base(sessionID))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return entity.ContentPart{}, err
+	}
+
+	name := make([]byte, 8)
+	rand.Read(name)
+	path := filepath.Join(dir, hex.EncodeToString(name)+ext)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return entity.ContentPart{}, err
+	}
+
+	return entity.ContentPart{Type: entity.PartImage, MediaType: mediaType, Path: path}, nil
+}
+
+// Load reads an image saved by Save, paths outside BaseDir are refused
+func (r *FileImageRepo) Load(ctx context.Context, path string) ([]byte, error) {
+	rel, err := filepath.Rel(r.BaseDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("image %s is outside %s", path, r.BaseDir)
+	}
+	return os.ReadFile(path)
+}
@@ -2,16 +2,37 @@ package local
 
 import (
 	"fmt"
+	"kepatrick/llm-playground/internal/domain/entity"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/xuri/excelize/v2"
 )
 
+// ExcelLogRepo logs to an Excel file, every access opens and saves the whole
+// file so calls are serialized
 type ExcelLogRepo struct {
+	mu       sync.Mutex
 	filePath string
 }
 
+// logHeaders are the columns of the log sheet, in the order Insert writes them
+var logHeaders = []string{
+	"Id", "ChatId", "ReqMessage", "ResMessage", "Prompt",
+	"ReqToken", "ResToken", "SendTime", "ReceiveTime", "Provider",
+	"TokenEstimated", "Interrupted", "ReasoningToken", "FinishReason", "Continuations",
+	"CachedToken", "Cost", "ArenaId", "CacheWriteToken",
+}
+
+// voteHeaders are the columns of the sheet of arena votes
+var voteHeaders = []string{"VoteTime", "ArenaId", "ChatId", "Apis", "Winner"}
+
+const voteSheet = "Votes"
+
 func NewExcelLogRepo(filePath string) *ExcelLogRepo {
 	// Make file if file not Exsist
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
@@ -19,24 +40,49 @@ func NewExcelLogRepo(filePath string) *ExcelLogRepo {
 		sheet := "Sheet1"
 		f.SetSheetName(f.GetSheetName(0), sheet)
 		// Write header
-		headers := []string{
-			"Id", "ChatId", "ReqMessage", "ResMessage", "Prompt",
-			"ReqToken", "ResToken", "SendTime", "ReceiveTime",
-		}
-		for i, h := range headers {
+		for i, h := range logHeaders {
 			cell, _ := excelize.CoordinatesToCellName(i+1, 1)
 			f.SetCellValue(sheet, cell, h)
 		}
 		_ = f.SaveAs(filePath)
+	} else if err := addMissingHeaders(filePath); err != nil {
+		fmt.Printf("fail to update log headers: %v\n", err)
 	}
 	return &ExcelLogRepo{filePath: filePath}
 }
 
-func (r *ExcelLogRepo) Insert(sessionId, reqMsg, resMsg string, reqToken, resToken int, sendTime, receiveTime time.Time) error {
+// addMissingHeaders names the columns added since the file was created, so
+// they can be read back by header
+func addMissingHeaders(filePath string) error {
+	f, err := excelize.OpenFile(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	changed := false
+	for i, h := range logHeaders {
+		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+		if v, _ := f.GetCellValue("Sheet1", cell); v == "" {
+			f.SetCellValue("Sheet1", cell, h)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return f.Save()
+}
+
+func (r *ExcelLogRepo) Insert(rec entity.Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	f, err := excelize.OpenFile(r.filePath)
 	if err != nil {
 		return fmt.Errorf("failed to open Excel file: %w", err)
 	}
+	defer f.Close()
 
 	sheet := "Sheet1"
 	rows, err := f.GetRows(sheet)
@@ -46,20 +92,33 @@ func (r *ExcelLogRepo) Insert(sessionId, reqMsg, resMsg string, reqToken, resTok
 	rowIndex := len(rows) + 1
 
 	record := Record{
-		Id:          time.Now().Format("20060102150405"),
-		ChatId:      sessionId,
-		ReqMessage:  reqMsg,
-		ResMessage:  resMsg,
-		Prompt:      "",
-		ReqToken:    reqToken,
-		ResToken:    resToken,
-		SendTime:    sendTime,
-		ReceiveTime: receiveTime,
+		Id:              entity.NewRecordID(),
+		ChatId:          rec.SessionID,
+		ReqMessage:      rec.ReqMessage,
+		ResMessage:      rec.ResMessage,
+		Prompt:          "",
+		ReqToken:        rec.ReqToken,
+		ResToken:        rec.ResToken,
+		SendTime:        rec.SendTime,
+		ReceiveTime:     rec.ReceiveTime,
+		Provider:        rec.Provider,
+		TokenEstimated:  rec.TokenEstimated,
+		Interrupted:     rec.Interrupted,
+		ReasoningToken:  rec.ReasoningToken,
+		FinishReason:    rec.FinishReason,
+		Continuations:   rec.Continuations,
+		CachedToken:     rec.CachedToken,
+		Cost:            rec.Cost,
+		ArenaId:         rec.ArenaID,
+		CacheWriteToken: rec.CacheWriteToken,
 	}
 
 	values := []interface{}{
 		record.Id, record.ChatId, record.ReqMessage, record.ResMessage, record.Prompt,
 		record.ReqToken, record.ResToken, record.SendTime.Format(time.RFC3339), record.ReceiveTime.Format(time.RFC3339),
+		record.Provider, record.TokenEstimated, record.Interrupted, record.ReasoningToken,
+		record.FinishReason, record.Continuations, record.CachedToken, record.Cost,
+		record.ArenaId, record.CacheWriteToken,
 	}
 
 	for i, val := range values {
@@ -75,13 +134,146 @@ func (r *ExcelLogRepo) Insert(sessionId, reqMsg, resMsg string, reqToken, resTok
 }
 
 type Record struct {
-	Id          string
-	ChatId      string
-	ReqMessage  string
-	ResMessage  string
-	Prompt      string
-	ReqToken    int
-	ResToken    int
-	SendTime    time.Time
-	ReceiveTime time.Time
+	Id              string
+	ChatId          string
+	ReqMessage      string
+	ResMessage      string
+	Prompt          string
+	ReqToken        int
+	ResToken        int
+	SendTime        time.Time
+	ReceiveTime     time.Time
+	Provider        string
+	TokenEstimated  bool
+	Interrupted     bool
+	ReasoningToken  int
+	FinishReason    string
+	Continuations   int
+	CachedToken     int
+	Cost            float64
+	ArenaId         string
+	CacheWriteToken int
+}
+
+// InsertVote appends the vote to the Votes sheet, created on the first vote
+func (r *ExcelLogRepo) InsertVote(vote entity.Vote) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, err := excelize.OpenFile(r.filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open Excel file: %w", err)
+	}
+	defer f.Close()
+
+	if idx, _ := f.GetSheetIndex(voteSheet); idx == -1 {
+		if _, err := f.NewSheet(voteSheet); err != nil {
+			return fmt.Errorf("failed to add votes sheet: %w", err)
+		}
+		for i, h := range voteHeaders {
+			cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+			f.SetCellValue(voteSheet, cell, h)
+		}
+	}
+	rows, err := f.GetRows(voteSheet)
+	if err != nil {
+		return fmt.Errorf("failed to read rows: %w", err)
+	}
+
+	values := []interface{}{
+		vote.VoteTime.Format(time.RFC3339), vote.ArenaID, vote.SessionID, strings.Join(vote.Apis, ","), vote.Winner,
+	}
+	for i, val := range values {
+		cell, _ := excelize.CoordinatesToCellName(i+1, len(rows)+1)
+		f.SetCellValue(voteSheet, cell, val)
+	}
+	if err := f.Save(); err != nil {
+		return fmt.Errorf("failed to save Excel file: %w", err)
+	}
+	return nil
+}
+
+func (r *ExcelLogRepo) SessionCost(sessionID string) (entity.CostTotal, error) {
+	total := entity.CostTotal{SessionID: sessionID}
+	recs, err := r.records()
+	if err != nil {
+		return total, err
+	}
+	for _, rec := range recs {
+		if rec.SessionID == sessionID {
+			total.Add(rec)
+		}
+	}
+	return total, nil
+}
+
+func (r *ExcelLogRepo) DailyCosts(from, to time.Time) ([]entity.CostTotal, error) {
+	recs, err := r.records()
+	if err != nil {
+		return nil, err
+	}
+	byDay := map[string]*entity.CostTotal{}
+	var days []string
+	for _, rec := range recs {
+		if rec.SendTime.Before(from) || !rec.SendTime.Before(to) {
+			continue
+		}
+		day := rec.SendTime.Local().Format(time.DateOnly)
+		if _, ok := byDay[day]; !ok {
+			byDay[day] = &entity.CostTotal{Day: day}
+			days = append(days, day)
+		}
+		byDay[day].Add(rec)
+	}
+	sort.Strings(days)
+	totals := make([]entity.CostTotal, 0, len(days))
+	for _, day := range days {
+		totals = append(totals, *byDay[day])
+	}
+	return totals, nil
+}
+
+// records reads back the token and cost columns of every row, columns are
+// looked up by header so files written before a column was added still read
+func (r *ExcelLogRepo) records() ([]entity.Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, err := excelize.OpenFile(r.filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Excel file: %w", err)
+	}
+	defer f.Close()
+
+	rows, err := f.GetRows("Sheet1", excelize.Options{RawCellValue: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rows: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	col := map[string]int{}
+	for i, h := range rows[0] {
+		col[h] = i
+	}
+	cell := func(row []string, name string) string {
+		if i, ok := col[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	recs := make([]entity.Record, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		rec := entity.Record{SessionID: cell(row, "ChatId")}
+		rec.ReqToken, _ = strconv.Atoi(cell(row, "ReqToken"))
+		rec.ResToken, _ = strconv.Atoi(cell(row, "ResToken"))
+		rec.CachedToken, _ = strconv.Atoi(cell(row, "CachedToken"))
+		rec.CacheWriteToken, _ = strconv.Atoi(cell(row, "CacheWriteToken"))
+		rec.TokenEstimated, _ = strconv.ParseBool(cell(row, "TokenEstimated"))
+		rec.Cost, _ = strconv.ParseFloat(cell(row, "Cost"), 64)
+		rec.SendTime, _ = time.Parse(time.RFC3339, cell(row, "SendTime"))
+		recs = append(recs, rec)
+	}
+	return recs, nil
 }
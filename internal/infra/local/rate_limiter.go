@@ -0,0 +1,51 @@
+package local
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryRateLimiter keeps the token buckets of a single instance in memory
+type MemoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Constructor for MemoryRateLimiter
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: map[string]*bucket{}}
+}
+
+func (l *MemoryRateLimiter) Take(ctx context.Context, key string, n, perMinute int, maxWait time.Duration) (time.Duration, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	capacity := float64(perMinute)
+	rate := capacity / float64(time.Minute) // tokens per nanosecond
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(capacity, b.tokens+float64(now.Sub(b.last))*rate)
+	b.last = now
+
+	after := b.tokens - float64(n)
+	var wait time.Duration
+	if after < 0 {
+		wait = time.Duration(-after / rate)
+	}
+	if maxWait >= 0 && wait > maxWait {
+		return wait, false, nil
+	}
+	b.tokens = after
+	return wait, true, nil
+}
@@ -0,0 +1,80 @@
+package local
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimiterTake(t *testing.T) {
+	type take struct {
+		key      string
+		n        int
+		maxWait  time.Duration
+		wantWait time.Duration
+		wantOK   bool
+	}
+	// 60 per minute refills one token a second
+	const perMinute = 60
+	tests := []struct {
+		name  string
+		takes []take
+	}{
+		{
+			name: "full bucket serves without wait",
+			takes: []take{
+				{"a", 60, 0, 0, true},
+				{"a", 1, 0, time.Second, false},
+			},
+		},
+		{
+			name: "wait within maxWait is granted and leaves a debt",
+			takes: []take{
+				{"a", 60, 0, 0, true},
+				{"a", 30, time.Minute, 30 * time.Second, true},
+				{"a", 30, time.Minute, time.Minute, true},
+				{"a", 1, time.Minute, 61 * time.Second, false},
+			},
+		},
+		{
+			name: "rejected take costs nothing",
+			takes: []take{
+				{"a", 100, 10 * time.Second, 40 * time.Second, false},
+				{"a", 60, 0, 0, true},
+			},
+		},
+		{
+			name: "negative maxWait waits as long as needed",
+			takes: []take{
+				{"a", 60, 0, 0, true},
+				{"a", 120, -1, 2 * time.Minute, true},
+			},
+		},
+		{
+			name: "keys have buckets of their own",
+			takes: []take{
+				{"a", 60, 0, 0, true},
+				{"b", 60, 0, 0, true},
+				{"a", 6, 0, 6 * time.Second, false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewMemoryRateLimiter()
+			for i, tk := range tt.takes {
+				wait, ok, err := l.Take(context.Background(), tk.key, tk.n, perMinute, tk.maxWait)
+				if err != nil {
+					t.Fatalf("take %d: %v", i, err)
+				}
+				if ok != tk.wantOK {
+					t.Errorf("take %d: ok = %v, want %v", i, ok, tk.wantOK)
+				}
+				// the bucket refills between takes, by far less than this
+				if d := wait - tk.wantWait; d > 100*time.Millisecond || d < -100*time.Millisecond {
+					t.Errorf("take %d: wait = %v, want %v", i, wait, tk.wantWait)
+				}
+			}
+		})
+	}
+}
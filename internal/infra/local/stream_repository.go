@@ -0,0 +1,153 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryStreamRepo buffers the latest turn of every session in a ring buffer
+type MemoryStreamRepo struct {
+	size int           // events kept per turn, older ones are dropped
+	ttl  time.Duration // how long a finished turn stays replayable
+
+	mu      sync.Mutex
+	streams map[string]*memoryStream
+}
+
+type memoryStream struct {
+	buf     []entity.StreamEvent
+	head    int // index of the oldest event
+	count   int
+	nextID  int64
+	closed  bool
+	changed chan struct{} // closed and replaced whenever an event arrives or the turn ends
+	expiry  *time.Timer
+}
+
+// Constructor for MemoryStreamRepo
+func NewMemoryStreamRepo(size int, ttl time.Duration) *MemoryStreamRepo {
+	return &MemoryStreamRepo{size: size, ttl: ttl, streams: map[string]*memoryStream{}}
+}
+
+func (r *MemoryStreamRepo) Open(ctx context.Context, sessionID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if old, ok := r.streams[sessionID]; ok {
+		if old.expiry != nil {
+			old.expiry.Stop()
+		}
+		// Wake readers of the replaced turn, they see it closed
+		old.closed = true
+		close(old.changed)
+	}
+	r.streams[sessionID] = &memoryStream{
+		buf:     make([]entity.StreamEvent, r.size),
+		changed: make(chan struct{}),
+	}
+	return nil
+}
+
+func (r *MemoryStreamRepo) Append(ctx context.Context, sessionID string, event entity.StreamEvent) (entity.StreamEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.streams[sessionID]
+	if !ok || s.closed {
+		return event, fmt.Errorf("no open stream for session %s", sessionID)
+	}
+
+	s.nextID++
+	event.ID = strconv.FormatInt(s.nextID, 10)
+	if s.count < len(s.buf) {
+		s.buf[(s.head+s.count)%len(s.buf)] = event
+		s.count++
+	} else {
+		s.buf[s.head] = event
+		s.head = (s.head + 1) % len(s.buf)
+	}
+	s.notify()
+	return event, nil
+}
+
+func (r *MemoryStreamRepo) Close(ctx context.Context, sessionID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.streams[sessionID]
+	if !ok || s.closed {
+		return nil
+	}
+	s.closed = true
+	s.notify()
+
+	s.expiry = time.AfterFunc(r.ttl, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.streams[sessionID] == s {
+			delete(r.streams, sessionID)
+		}
+	})
+	return nil
+}
+
+func (r *MemoryStreamRepo) Read(ctx context.Context, sessionID, lastID string) ([]entity.StreamEvent, bool, error) {
+	var after int64
+	if lastID != "" {
+		var err error
+		if after, err = strconv.ParseInt(lastID, 10, 64); err != nil {
+			return nil, false, fmt.Errorf("invalid event id %q", lastID)
+		}
+	}
+
+	for {
+		r.mu.Lock()
+		s, ok := r.streams[sessionID]
+		if !ok {
+			r.mu.Unlock()
+			return nil, true, nil
+		}
+		events := s.since(after)
+		closed, changed := s.closed, s.changed
+		r.mu.Unlock()
+
+		if len(events) > 0 || closed {
+			return events, len(events) == 0, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (r *MemoryStreamRepo) Exists(ctx context.Context, sessionID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.streams[sessionID]
+	return ok
+}
+
+// since returns the buffered events with an id above after, oldest first
+func (s *memoryStream) since(after int64) []entity.StreamEvent {
+	// ids are consecutive, so the first wanted event is found by offset
+	oldest := s.nextID - int64(s.count) + 1
+	skip := int(max(after-oldest+1, 0))
+
+	var events []entity.StreamEvent
+	for i := skip; i < s.count; i++ {
+		events = append(events, s.buf[(s.head+i)%len(s.buf)])
+	}
+	return events
+}
+
+func (s *memoryStream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
@@ -0,0 +1,59 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript refills and takes from the bucket atomically, on the clock of
+// the Redis server so that every instance agrees. It returns whether the
+// tokens were taken and the wait in milliseconds.
+var takeScript = redis.NewScript(`
+local capacity = tonumber(ARGV[2])
+local rate = capacity / 60000
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + tonumber(t[2]) / 1000
+
+local tokens = tonumber(redis.call('HGET', KEYS[1], 'tokens') or capacity)
+local last = tonumber(redis.call('HGET', KEYS[1], 'last') or now)
+tokens = math.min(capacity, tokens + (now - last) * rate)
+
+local after = tokens - tonumber(ARGV[1])
+local wait = 0
+if after < 0 then
+	wait = math.ceil(-after / rate)
+end
+local maxWait = tonumber(ARGV[3])
+if maxWait >= 0 and wait > maxWait then
+	redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+	redis.call('PEXPIRE', KEYS[1], 60000)
+	return {0, wait}
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(after), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], wait + 60000)
+return {1, wait}
+`)
+
+// RedisRateLimiter shares the token buckets between instances, the key
+// "ratelimit:<key>"
+type RedisRateLimiter struct {
+	Client *redis.Client
+}
+
+func NewRedisRateLimiter(client *redis.Client) *RedisRateLimiter {
+	return &RedisRateLimiter{Client: client}
+}
+
+func (l *RedisRateLimiter) Take(ctx context.Context, key string, n, perMinute int, maxWait time.Duration) (time.Duration, bool, error) {
+	maxWaitMs := int64(-1)
+	if maxWait >= 0 {
+		maxWaitMs = maxWait.Milliseconds()
+	}
+	res, err := takeScript.Run(ctx, l.Client, []string{"ratelimit:" + key}, n, perMinute, maxWaitMs).Int64Slice()
+	if err != nil {
+		return 0, false, err
+	}
+	return time.Duration(res[1]) * time.Millisecond, res[0] == 1, nil
+}
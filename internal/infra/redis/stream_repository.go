@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"context"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// readBlock bounds a blocking XREAD, so that the end of the turn is noticed
+const readBlock = time.Second
+
+// RedisStreamRepo buffers the latest turn of every session in a Redis stream
+// capped at size entries, the key "<sessionID>:stream"
+type RedisStreamRepo struct {
+	Client *redis.Client
+	size   int64
+	ttl    time.Duration
+}
+
+func NewRedisStreamRepo(client *redis.Client, size int, ttl time.Duration) *RedisStreamRepo {
+	return &RedisStreamRepo{Client: client, size: int64(size), ttl: ttl}
+}
+
+func streamKey(sessionID string) string { return sessionID + ":stream" }
+
+func closedKey(sessionID string) string { return sessionID + ":stream:closed" }
+
+func (r *RedisStreamRepo) Open(ctx context.Context, sessionID string) error {
+	return r.Client.Del(ctx, streamKey(sessionID), closedKey(sessionID)).Err()
+}
+
+func (r *RedisStreamRepo) Append(ctx context.Context, sessionID string, event entity.StreamEvent) (entity.StreamEvent, error) {
+	id, err := r.Client.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamKey(sessionID),
+		MaxLen: r.size,
+		Approx: true,
+		Values: map[string]interface{}{"type": event.Type, "data": event.Data},
+	}).Result()
+	event.ID = id
+	return event, err
+}
+
+// Close flags the turn as finished, both keys expire after ttl
+func (r *RedisStreamRepo) Close(ctx context.Context, sessionID string) error {
+	pipe := r.Client.TxPipeline()
+	pipe.Set(ctx, closedKey(sessionID), 1, r.ttl)
+	pipe.Expire(ctx, streamKey(sessionID), r.ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *RedisStreamRepo) Read(ctx context.Context, sessionID, lastID string) ([]entity.StreamEvent, bool, error) {
+	if lastID == "" {
+		lastID = "0"
+	}
+
+	for {
+		// Check the flag before reading, so events appended before Close are never missed
+		closed, err := r.Client.Exists(ctx, closedKey(sessionID)).Result()
+		if err != nil {
+			return nil, false, err
+		}
+
+		block := readBlock
+		if closed > 0 {
+			block = -1 // no BLOCK argument
+		}
+		res, err := r.Client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{streamKey(sessionID), lastID},
+			Block:   block,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			return nil, false, err
+		}
+
+		var events []entity.StreamEvent
+		for _, s := range res {
+			for _, msg := range s.Messages {
+				typ, _ := msg.Values["type"].(string)
+				data, _ := msg.Values["data"].(string)
+				events = append(events, entity.StreamEvent{ID: msg.ID, Type: typ, Data: data})
+			}
+		}
+		if len(events) > 0 || closed > 0 {
+			return events, len(events) == 0, nil
+		}
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+func (r *RedisStreamRepo) Exists(ctx context.Context, sessionID string) bool {
+	count, err := r.Client.Exists(ctx, streamKey(sessionID)).Result()
+	if err != nil {
+		return false
+	}
+	return count > 0
+}
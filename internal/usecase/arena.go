@@ -0,0 +1,187 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"slices"
+	"sync"
+	"time"
+)
+
+// arenaTTL is how long an arena turn can still be voted on
+const arenaTTL = 24 * time.Hour
+
+// ErrArenaNotFound is returned by Vote for an unknown or expired arena turn
+var ErrArenaNotFound = errors.New("arena not found")
+
+// ErrInvalidVote is returned by Vote for a winner that is not part of the arena
+var ErrInvalidVote = errors.New("winner must be one of the compared apis, tie or both_bad")
+
+// ArenaBranch returns the session holding the conversation of an api in the
+// arena of a session, it can be read and resumed like any other session
+func ArenaBranch(sessionID, api string) string {
+	return sessionID + "@" + api
+}
+
+// RunArena answers the prompt with every api concurrently, each in its own
+// branch of the session. The events of each api are tagged with its model,
+// the stream opens with an arena event naming the arena id to vote on and
+// ends with a done event of its own once every api is done.
+func (u *GenerateUsecase) RunArena(ctx context.Context, sessionID, prompt string, images []entity.ContentPart, apis []string, params service.GenerateParams, writer service.StreamWriter) error {
+	// Like RunStream the turn outlives the client, Cancel of the session stops every branch
+	ctx = context.WithoutCancel(ctx)
+	arenaID := fmt.Sprintf("%s-%d", sessionID, time.Now().UnixMilli())
+	u.arenas.add(arenaID, sessionID, apis)
+
+	for _, api := range apis {
+		if err := u.seedBranch(ctx, sessionID, ArenaBranch(sessionID, api)); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := u.running.start(ctx, sessionID)
+	defer stop()
+
+	writer.Send(service.ArenaEvent(arenaID, apis))
+	var wg sync.WaitGroup
+	for _, api := range apis {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &arenaWriter{StreamWriter: writer, model: api}
+			p := params
+			p.Api = api
+			if err := u.runTurn(ctx, ArenaBranch(sessionID, api), prompt, images, p, w, arenaID); err != nil {
+				w.Send(service.ErrorEvent(err))
+			}
+		}()
+	}
+	wg.Wait()
+	writer.Send(service.DoneEvent())
+	return nil
+}
+
+// seedBranch starts a branch from the history of the session, so every api
+// answers with the conversation so far. An existing branch is caught up with
+// the messages the session got since its last arena turn, summaries of the
+// session are left out as they count messages of the session, not of the
+// branch, which summarizes itself.
+func (u *GenerateUsecase) seedBranch(ctx context.Context, sessionID, branch string) error {
+	if !u.sessionRepo.ExistKey(ctx, sessionID) {
+		return nil
+	}
+	history, err := u.sessionRepo.FetchPrevMessage(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+
+	seen := map[branchKey]bool{}
+	fresh := !u.sessionRepo.ExistKey(ctx, branch)
+	if !fresh {
+		kept, err := u.sessionRepo.FetchPrevMessage(ctx, branch)
+		if err != nil {
+			return err
+		}
+		for _, msg := range kept {
+			seen[keyOf(msg)] = true
+		}
+	}
+	for _, msg := range history {
+		if !fresh && (msg.Summary || seen[keyOf(msg)]) {
+			continue
+		}
+		if err := u.sessionRepo.AppendMessage(ctx, branch, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// branchKey tells a message of the session apart, copies in a branch keep it
+type branchKey struct {
+	role, timestamp, content string
+}
+
+func keyOf(msg entity.Message) branchKey {
+	return branchKey{msg.Role, msg.Timestamp, msg.Content}
+}
+
+// Vote records which api of an arena turn gave the preferred answer, winner
+// is the api name, entity.VoteTie or entity.VoteBothBad
+func (u *GenerateUsecase) Vote(arenaID, winner string) error {
+	arena, ok := u.arenas.get(arenaID)
+	if !ok {
+		return ErrArenaNotFound
+	}
+	if winner != entity.VoteTie && winner != entity.VoteBothBad && !slices.Contains(arena.apis, winner) {
+		return ErrInvalidVote
+	}
+	return u.logRepo.InsertVote(entity.Vote{
+		ArenaID:   arenaID,
+		SessionID: arena.sessionID,
+		Apis:      arena.apis,
+		Winner:    winner,
+		VoteTime:  time.Now(),
+	})
+}
+
+// arenaTurns remembers the apis of recent arena turns until they expire
+type arenaTurns struct {
+	mu    sync.Mutex
+	turns map[string]arenaTurn
+}
+
+type arenaTurn struct {
+	sessionID string
+	apis      []string
+	started   time.Time
+}
+
+func (a *arenaTurns) add(arenaID, sessionID string, apis []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.turns == nil {
+		a.turns = map[string]arenaTurn{}
+	}
+	now := time.Now()
+	for id, t := range a.turns {
+		if now.Sub(t.started) > arenaTTL {
+			delete(a.turns, id)
+		}
+	}
+	a.turns[arenaID] = arenaTurn{sessionID, apis, now}
+}
+
+func (a *arenaTurns) get(arenaID string) (arenaTurn, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, ok := a.turns[arenaID]
+	if ok && time.Since(t.started) > arenaTTL {
+		return t, false
+	}
+	return t, ok
+}
+
+// arenaWriter adds the model of a branch to the data of its events. Event
+// ids are left out, they count the events of the branch alone.
+type arenaWriter struct {
+	service.StreamWriter
+	model string
+}
+
+func (w *arenaWriter) Send(event service.StreamEvent) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	fields["model"] = w.model
+	return w.StreamWriter.Send(service.StreamEvent{Type: event.Type, Data: fields})
+}
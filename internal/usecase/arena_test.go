@@ -0,0 +1,54 @@
+package usecase
+
+import (
+	"context"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"slices"
+	"testing"
+)
+
+func TestSeedBranch(t *testing.T) {
+	msg := func(role, content, ts string) entity.Message {
+		return entity.Message{Role: role, Content: content, Timestamp: ts}
+	}
+	sessions := &memSessions{msgs: map[string][]entity.Message{
+		"s1": {msg("user", "hi", "1"), msg("assistant", "hello", "2")},
+	}}
+	u := &GenerateUsecase{sessionRepo: sessions}
+	ctx := context.Background()
+	contents := func(id string) []string {
+		msgs, _ := sessions.FetchPrevMessage(ctx, id)
+		var out []string
+		for _, m := range msgs {
+			out = append(out, m.Content)
+		}
+		return out
+	}
+
+	// a new branch takes the whole history
+	if err := u.seedBranch(ctx, "s1", "s1@a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := contents("s1@a"); !slices.Equal(got, []string{"hi", "hello"}) {
+		t.Fatalf("seeded branch = %v", got)
+	}
+
+	// an arena turn in the branch, then the session goes on without the arena
+	sessions.AppendMessage(ctx, "s1@a", msg("user", "compare", "3"))
+	sessions.AppendMessage(ctx, "s1@a", msg("assistant", "answer a", "4"))
+	sessions.AppendMessage(ctx, "s1", msg("system", "summary", "5"))
+	sessions.msgs["s1"][2].Summary = true
+	sessions.AppendMessage(ctx, "s1", msg("user", "more", "6"))
+	sessions.AppendMessage(ctx, "s1", msg("assistant", "sure", "7"))
+
+	// the next arena turn catches the branch up, once
+	for range 2 {
+		if err := u.seedBranch(ctx, "s1", "s1@a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"hi", "hello", "compare", "answer a", "more", "sure"}
+	if got := contents("s1@a"); !slices.Equal(got, want) {
+		t.Fatalf("synced branch = %v, want %v", got, want)
+	}
+}
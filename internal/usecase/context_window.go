@@ -0,0 +1,99 @@
+package usecase
+
+import (
+	"encoding/json"
+	"fmt"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"kepatrick/llm-playground/pkg/approxtoken"
+)
+
+// defaultReplyTokens is the room kept for the answer when maxTokens is unset
+const defaultReplyTokens = 2048
+
+// contextMarginPercent of the window is kept free, the history is sized by
+// approxtoken and may be longer than estimated
+const contextMarginPercent = 10
+
+// contextBudget returns the tokens the messages of a call may use, 0 means
+// no api of the call declares a context window. Every api that may serve the
+// call counts, a fallback with a smaller window must still fit the history.
+func contextBudget(params service.GenerateParams) int {
+	apis := config.LoadApis()
+	chain := config.LoadOption().ApiChain()
+	if params.Api != "" {
+		chain = []string{params.Api}
+	}
+
+	window := 0
+	for _, name := range chain {
+		if w := apis[name].ContextWindow; w > 0 && (window == 0 || w < window) {
+			window = w
+		}
+	}
+	if window == 0 {
+		return 0
+	}
+
+	reply := defaultReplyTokens
+	if params.MaxTokens != nil {
+		reply = *params.MaxTokens
+	}
+	tools, _ := json.Marshal(config.LoadToolDef())
+	margin := window * contextMarginPercent / 100
+	return max(window-margin-reply-approxtoken.Estimate(string(tools)), 1)
+}
+
+// fitContext returns the messages to send within budget and how many were
+// left out. The leading system prompt and everything from current, the user
+// message of this turn, are always kept. Older turns are dropped oldest first
+// and replaced by a note; the history is only cut before a user message, so an
+// assistant tool_calls message is never separated from its tool results.
+func fitContext(messages []entity.Message, current, budget int) ([]entity.Message, int) {
+	if budget <= 0 || approxtoken.EstimateMessages(messages) <= budget {
+		return messages, 0
+	}
+
+	head := 0
+	for head < current && messages[head].Role == "system" {
+		head++
+	}
+
+	// The note is sized for the longest count it can hold
+	note := entity.Message{Role: "system", Content: omittedNote(current - head), Timestamp: nowMilli()}
+	total := approxtoken.EstimateMessages(messages[:head]) + approxtoken.EstimateMessages(messages[current:]) + approxtoken.EstimateMessage(note) + approxtoken.TokensPerMessage
+
+	cut := current
+	older := 0
+	for i := current - 1; i >= head; i-- {
+		older += approxtoken.EstimateMessage(messages[i]) + approxtoken.TokensPerMessage
+		if total+older > budget {
+			break
+		}
+		if messages[i].Role == "user" {
+			total += older
+			older = 0
+			cut = i
+		}
+	}
+	if total > budget {
+		fmt.Printf("latest turn needs %d tokens, more than the context budget of %d\n", total, budget)
+	}
+
+	trimmed := cut - head
+	if trimmed == 0 {
+		return messages, 0
+	}
+	note.Content = omittedNote(trimmed)
+
+	sent := make([]entity.Message, 0, head+1+len(messages)-cut)
+	sent = append(sent, messages[:head]...)
+	sent = append(sent, note)
+	sent = append(sent, messages[cut:]...)
+	return sent, trimmed
+}
+
+func omittedNote(n int) string {
+	return fmt.Sprintf("%d earlier messages of this conversation were omitted to fit the context window.", n)
+}
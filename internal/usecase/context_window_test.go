@@ -0,0 +1,78 @@
+package usecase
+
+import (
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/pkg/approxtoken"
+	"testing"
+)
+
+func TestFitContext(t *testing.T) {
+	msg := func(role, content string) entity.Message {
+		return entity.Message{Role: role, Content: content}
+	}
+	sys := msg("system", "You are a helpful assistant.")
+	first := []entity.Message{
+		msg("user", "Tell me about the history of the Roman empire in some detail please."),
+		msg("assistant", "The Roman empire began in 27 BC when Augustus became the first emperor, and lasted in the west until 476."),
+	}
+	// a turn with a tool call, its results must stay with it
+	tools := []entity.Message{
+		msg("user", "What is the weather in Rome today?"),
+		{Role: "assistant", ToolCalls: []map[string]interface{}{{
+			"id": "call_1", "type": "function",
+			"function": map[string]interface{}{"name": "get_weather", "arguments": `{"city":"Rome"}`},
+		}}},
+		{Role: "tool", ToolCallID: "call_1", Content: `{"temperature":21,"sky":"clear"}`},
+		msg("assistant", "It is 21 degrees and clear in Rome."),
+	}
+	current := msg("user", "Thanks, and what about tomorrow?")
+
+	history := append(append(append([]entity.Message{sys}, first...), tools...), current)
+	cur := len(history) - 1
+	tokens := approxtoken.EstimateMessages
+	note := func(n int) int {
+		return approxtoken.EstimateMessage(msg("system", omittedNote(n))) + approxtoken.TokensPerMessage
+	}
+	// what must always be sent once something is left out
+	kept := tokens([]entity.Message{sys, current})
+
+	tests := []struct {
+		name        string
+		budget      int
+		wantTrimmed int
+		wantFrom    int // index of history the sent messages continue from after the note
+	}{
+		{"no budget", 0, 0, 0},
+		{"everything fits", tokens(history), 0, 0},
+		{"oldest turn left out", kept + note(2) + tokens(tools), 2, 3},
+		{"tool turn is not split", kept + note(6) + tokens(tools) - 1, 6, cur},
+		{"latest turn alone over budget", 1, 6, cur},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent, trimmed := fitContext(history, cur, tt.budget)
+			if trimmed != tt.wantTrimmed {
+				t.Fatalf("trimmed = %d, want %d", trimmed, tt.wantTrimmed)
+			}
+			if trimmed == 0 {
+				if len(sent) != len(history) {
+					t.Errorf("sent %d messages, want the whole history of %d", len(sent), len(history))
+				}
+				return
+			}
+
+			want := append([]entity.Message{sys, msg("system", omittedNote(trimmed))}, history[tt.wantFrom:]...)
+			if len(sent) != len(want) {
+				t.Fatalf("sent %d messages, want %d", len(sent), len(want))
+			}
+			for i := range want {
+				if sent[i].Role != want[i].Role || sent[i].Content != want[i].Content || sent[i].ToolCallID != want[i].ToolCallID {
+					t.Errorf("message %d = %s %q, want %s %q", i, sent[i].Role, sent[i].Content, want[i].Role, want[i].Content)
+				}
+			}
+			if tt.budget >= kept+note(trimmed) && tokens(sent) > tt.budget {
+				t.Errorf("sent %d tokens, over the budget of %d", tokens(sent), tt.budget)
+			}
+		})
+	}
+}
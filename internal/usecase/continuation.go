@@ -0,0 +1,33 @@
+package usecase
+
+import (
+	"kepatrick/llm-playground/internal/domain/entity"
+)
+
+// continuePrompt asks the model for the rest of an answer cut at max tokens
+const continuePrompt = "Your previous answer was cut off. Continue exactly where it stopped, without repeating anything or adding any preamble."
+
+// isAnswer reports whether the conversation ends with an assistant answer that can be continued
+func isAnswer(messages []entity.Message) bool {
+	if len(messages) == 0 {
+		return false
+	}
+	last := messages[len(messages)-1]
+	return last.Role == "assistant" && len(last.ToolCalls) == 0
+}
+
+// mergeContinuation folds the answer that followed the continue prompt into
+// the assistant message at index at, and drops the prompt. A continuation that
+// went through tool calls is left as it is, merging would break their order.
+func mergeContinuation(messages []entity.Message, at int) []entity.Message {
+	if len(messages) != at+3 || !isAnswer(messages) {
+		return messages
+	}
+	merged := messages[at]
+	next := messages[at+2]
+	merged.Content += next.Content
+	merged.ReasoningContent += next.ReasoningContent
+	merged.Timestamp = next.Timestamp
+	merged.Interrupted = next.Interrupted
+	return append(messages[:at], merged)
+}
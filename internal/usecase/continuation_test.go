@@ -0,0 +1,144 @@
+package usecase
+
+import (
+	"context"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memSessions keeps the sessions in memory
+type memSessions struct {
+	mu   sync.Mutex
+	msgs map[string][]entity.Message
+}
+
+func (r *memSessions) AppendMessage(ctx context.Context, sessionID string, msg entity.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs[sessionID] = append(r.msgs[sessionID], msg)
+	return nil
+}
+
+func (r *memSessions) FetchPrevMessage(ctx context.Context, sessionID string) ([]entity.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.msgs[sessionID]), nil
+}
+
+func (r *memSessions) ExistKey(ctx context.Context, sessionID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.msgs[sessionID]
+	return ok
+}
+
+// recordLog hands every inserted record to the test
+type recordLog struct {
+	records chan entity.Record
+}
+
+func (r *recordLog) Insert(record entity.Record) error {
+	r.records <- record
+	return nil
+}
+
+func (r *recordLog) SessionCost(sessionID string) (entity.CostTotal, error) {
+	return entity.CostTotal{}, nil
+}
+
+func (r *recordLog) DailyCosts(from, to time.Time) ([]entity.CostTotal, error) {
+	return nil, nil
+}
+
+func (r *recordLog) InsertVote(vote entity.Vote) error { return nil }
+
+// nopStreams buffers nothing
+type nopStreams struct{}
+
+func (nopStreams) Open(ctx context.Context, sessionID string) error { return nil }
+
+func (nopStreams) Append(ctx context.Context, sessionID string, event entity.StreamEvent) (entity.StreamEvent, error) {
+	return event, nil
+}
+
+func (nopStreams) Close(ctx context.Context, sessionID string) error { return nil }
+
+func (nopStreams) Read(ctx context.Context, sessionID, lastID string) ([]entity.StreamEvent, bool, error) {
+	return nil, true, nil
+}
+
+func (nopStreams) Exists(ctx context.Context, sessionID string) bool { return false }
+
+// cutLLM answers the first call with a text cut at max tokens, and is
+// cancelled while streaming the continuation
+type cutLLM struct {
+	cancel func()
+	sent   [][]entity.Message
+}
+
+func (s *cutLLM) StreamingCall(ctx context.Context, messages []entity.Message, params service.GenerateParams, writer service.StreamWriter, lastRslt service.LLMResult) (service.LLMResult, error) {
+	s.sent = append(s.sent, messages)
+	if len(s.sent) == 1 {
+		writer.Send(service.TokenEvent("The first half"))
+		return service.LLMResult{
+			LlmRes:       "The first half",
+			Messages:     append(slices.Clip(messages), entity.Message{Role: "assistant", Content: "The first half"}),
+			FinishReason: service.FinishLength,
+		}, nil
+	}
+	writer.Send(service.TokenEvent(" and the sec"))
+	s.cancel()
+	return lastRslt, ctx.Err()
+}
+
+func TestCancelDuringContinuation(t *testing.T) {
+	// options.json enables autoContinue
+	wd, _ := os.Getwd()
+	if err := os.Chdir("testdata"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	sessions := &memSessions{msgs: map[string][]entity.Message{}}
+	logs := &recordLog{records: make(chan entity.Record, 1)}
+	llm := &cutLLM{}
+	u := NewGenerateUsecase(llm, sessions, logs, nil, nopStreams{})
+	llm.cancel = func() { u.Cancel("s1") }
+
+	if err := u.runTurn(context.Background(), "s1", "Tell me a story", nil, service.GenerateParams{}, discardWriter{}, ""); err != nil {
+		t.Fatalf("runTurn: %v", err)
+	}
+	if len(llm.sent) != 2 || llm.sent[1][len(llm.sent[1])-1].Content != continuePrompt {
+		t.Fatalf("the cancelled call was not a continuation")
+	}
+
+	select {
+	case record := <-logs.records:
+		if want := "The first half and the sec"; record.ResMessage != want {
+			t.Errorf("logged answer = %q, want %q", record.ResMessage, want)
+		}
+		if !record.Interrupted {
+			t.Errorf("record not marked interrupted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record logged")
+	}
+
+	// the continue prompt is not history, the answer is one message
+	msgs, _ := sessions.FetchPrevMessage(context.Background(), "s1")
+	roles := []string{}
+	for _, m := range msgs {
+		roles = append(roles, m.Role)
+	}
+	if !slices.Equal(roles, []string{"system", "user", "assistant"}) {
+		t.Fatalf("session roles = %v, want system, user, assistant", roles)
+	}
+	if last := msgs[2]; last.Content != "The first half and the sec" || !last.Interrupted {
+		t.Errorf("answer = %q interrupted %v, want the merged answer marked interrupted", last.Content, last.Interrupted)
+	}
+}
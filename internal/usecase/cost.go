@@ -0,0 +1,38 @@
+package usecase
+
+import (
+	"fmt"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"time"
+)
+
+// turnCost prices the tokens of a turn with the model of the api that served
+// it. A turn spanning several calls is priced as a whole, so its tool calls and
+// continuations are included.
+func turnCost(record entity.Record) float64 {
+	api, ok := config.LoadApis()[record.Provider]
+	if !ok {
+		return 0
+	}
+	cost, ok := config.LoadPricing().Cost(api.Model, record.ReqToken, record.CachedToken, record.CacheWriteToken, record.ResToken)
+	if !ok {
+		fmt.Printf("no price for model %s, turn logged without cost\n", api.Model)
+	}
+	return cost
+}
+
+// SessionCost totals the cost and tokens of the logged turns of a session
+func (u *GenerateUsecase) SessionCost(sessionID string) (entity.CostTotal, error) {
+	return u.logRepo.SessionCost(sessionID)
+}
+
+// DailyCosts totals the cost and tokens of the turns sent from the day of from
+// through the day of to, by local day
+func (u *GenerateUsecase) DailyCosts(from, to time.Time) ([]entity.CostTotal, error) {
+	y, m, d := from.Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	y, m, d = to.Date()
+	end := time.Date(y, m, d+1, 0, 0, 0, 0, time.Local)
+	return u.logRepo.DailyCosts(start, end)
+}
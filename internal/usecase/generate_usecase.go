@@ -2,11 +2,17 @@ package usecase
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"kepatrick/llm-playground/internal/config"
 	"kepatrick/llm-playground/internal/domain/entity"
 	"kepatrick/llm-playground/internal/domain/repository"
 	"kepatrick/llm-playground/internal/domain/service"
+	"kepatrick/llm-playground/pkg/approxtoken"
+	"slices"
+	"sort"
 	"time"
 )
 
@@ -14,67 +20,406 @@ type GenerateUsecase struct {
 	llmSvc      service.LLMService
 	sessionRepo repository.SessionRepository
 	logRepo     repository.LogRepository
+	imageRepo   repository.ImageRepository
+	streamRepo  repository.StreamRepository
+	running     runningGenerations
+	arenas      arenaTurns
 }
 
-func NewGenerateUsecase(llmsvc service.LLMService, sessionRepo repository.SessionRepository, logRepo repository.LogRepository) *GenerateUsecase {
-	return &GenerateUsecase{llmsvc, sessionRepo, logRepo}
+// ErrStreamNotFound is returned by Resume when the session has no buffered turn
+var ErrStreamNotFound = errors.New("no stream for this session")
+
+// ErrSessionNotFound is returned by History for an unknown session
+var ErrSessionNotFound = errors.New("session not found")
+
+func NewGenerateUsecase(llmsvc service.LLMService, sessionRepo repository.SessionRepository, logRepo repository.LogRepository, imageRepo repository.ImageRepository, streamRepo repository.StreamRepository) *GenerateUsecase {
+	return &GenerateUsecase{llmSvc: llmsvc, sessionRepo: sessionRepo, logRepo: logRepo, imageRepo: imageRepo, streamRepo: streamRepo}
+}
+
+// SaveImage stores an image attached to a prompt of the session
+func (u *GenerateUsecase) SaveImage(ctx context.Context, sessionID, mediaType string, data []byte) (entity.ContentPart, error) {
+	return u.imageRepo.Save(ctx, sessionID, mediaType, data)
+}
+
+// ApiNames lists the api.json entries that can be picked per request
+func (u *GenerateUsecase) ApiNames() []string {
+	var names []string
+	for name := range config.LoadApis() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-func (u *GenerateUsecase) RunStream(ctx context.Context, sessionID, prompt string, writer service.StreamWriter) error {
+// ProvidersHealth reports the circuit state of every api, empty if the llm service tracks none
+func (u *GenerateUsecase) ProvidersHealth() []service.ProviderHealth {
+	if h, ok := u.llmSvc.(service.HealthReporter); ok {
+		return h.ProvidersHealth()
+	}
+	return nil
+}
+
+// ResolveParams checks the requested api and fills unset sampling parameters
+// with the defaults of options.json
+func (u *GenerateUsecase) ResolveParams(params service.GenerateParams) (service.GenerateParams, error) {
+	if params.Api != "" {
+		if _, ok := config.LoadApis()[params.Api]; !ok {
+			return params, fmt.Errorf("api %s not found in api config", params.Api)
+		}
+	}
+
+	def := config.LoadOption().DefaultParams
+	if params.Temperature == nil {
+		params.Temperature = def.Temperature
+	}
+	if params.TopP == nil {
+		params.TopP = def.TopP
+	}
+	if params.MaxTokens == nil {
+		params.MaxTokens = def.MaxTokens
+	}
+	if params.Stop == nil {
+		params.Stop = def.Stop
+	}
+	if params.Seed == nil {
+		params.Seed = def.Seed
+	}
+	if params.PresencePenalty == nil {
+		params.PresencePenalty = def.PresencePenalty
+	}
+	if params.FrequencyPenalty == nil {
+		params.FrequencyPenalty = def.FrequencyPenalty
+	}
+
+	// A named schema is loaded from configs/schemas, an inline one wins
+	if params.ResponseFormat != nil && params.ResponseFormat.Type == "json_schema" {
+		format := *params.ResponseFormat
+		if format.Schema == nil {
+			if format.Name == "" {
+				return params, fmt.Errorf("json_schema response format needs a schema or schemaName")
+			}
+			schema, err := config.LoadSchema(format.Name)
+			if err != nil {
+				return params, fmt.Errorf("fail to load schema %s: %v", format.Name, err)
+			}
+			format.Schema = schema
+		}
+		if format.Name == "" {
+			format.Name = "response"
+		}
+		params.ResponseFormat = &format
+	}
+	return params, nil
+}
+
+// RunStream answers the prompt, images are image_url parts or parts returned by SaveImage.
+// The turn outlives the client connection and only stops through Cancel.
+func (u *GenerateUsecase) RunStream(ctx context.Context, sessionID, prompt string, images []entity.ContentPart, params service.GenerateParams, writer service.StreamWriter) error {
+	return u.runTurn(context.WithoutCancel(ctx), sessionID, prompt, images, params, writer, "")
+}
+
+// runTurn answers the prompt in the session, arenaID links the log record to
+// the arena turn it is part of
+func (u *GenerateUsecase) runTurn(ctx context.Context, sessionID, prompt string, images []entity.ContentPart, params service.GenerateParams, writer service.StreamWriter, arenaID string) error {
 	fmt.Printf("receive prompt:%s", prompt)
 	if !u.sessionRepo.ExistKey(ctx, sessionID) {
-		u.sessionRepo.AppendMessage(ctx, sessionID, entity.Message{"system", config.LoadOption().SysPrompt, "", nil, nowMilli()})
+		u.sessionRepo.AppendMessage(ctx, sessionID, entity.Message{Role: "system", Content: config.LoadOption().SysPrompt, Timestamp: nowMilli()})
 	}
 	sendTime := time.Now()
-	u.sessionRepo.AppendMessage(ctx, sessionID, entity.Message{"user", prompt, "", nil, nowMilli()})
-	messages, err := u.sessionRepo.FetchPrevMessage(ctx, sessionID)
-
-	originMsgSize := len(messages)
+	userMsg := entity.Message{Role: "user", Content: prompt, Timestamp: nowMilli()}
+	if len(images) > 0 {
+		userMsg.Parts = append([]entity.ContentPart{{Type: entity.PartText, Text: prompt}}, images...)
+	}
+	u.sessionRepo.AppendMessage(ctx, sessionID, userMsg)
+	history, err := u.sessionRepo.FetchPrevMessage(ctx, sessionID)
 	if err != nil {
 		fmt.Printf("%v", err)
 		return err
 	}
 
+	// Events are buffered for Resume, the stop func unregisters the generation
+	if err := u.streamRepo.Open(ctx, sessionID); err != nil {
+		fmt.Printf("fail to open stream buffer: %v\n", err)
+	}
+	defer u.streamRepo.Close(ctx, sessionID)
+	buffer := &streamBuffer{StreamWriter: writer, ctx: ctx, repo: u.streamRepo, sessionID: sessionID}
+	writer = buffer
+
+	ctx, stop := u.running.start(ctx, sessionID)
+	defer stop()
+
+	messages := u.compact(ctx, sessionID, history, writer)
+	originMsgSize := len(messages)
+	u.loadImages(ctx, messages)
+
 	var llmRslt service.LLMResult
-	callLLm := true
+	recorder := &streamRecorder{StreamWriter: writer}
+	option := config.LoadOption()
+	maxRetries := option.StructuredOutputRetries
+	retries := 0
+	continuations := 0
+	continued := -1 // index of the assistant message being continued
+	answered := ""  // the answer so far when continuing
+	rejected := -1  // index of the first answer that failed the response format
+	corrected := -1 // index of the latest correction prompt
 
-	for callLLm {
-		llmRslt, err = u.llmSvc.StreamingCall(ctx, messages, writer, llmRslt)
-		// update messages
-		messages = llmRslt.Messages
+	budget := contextBudget(params)
+	current := originMsgSize - 1 // the user message of this turn
+	for current > 0 && messages[current].Role != "user" {
+		current--
+	}
+	reported := 0
 
+	for {
+		sent, trimmed := fitContext(messages, current, budget)
+		if trimmed > reported {
+			reported = trimmed
+			fmt.Printf("%d messages of session %s trimmed to fit the context window\n", trimmed, sessionID)
+			writer.Send(service.StatusEvent(fmt.Sprintf("%d earlier messages left out to fit the context window", trimmed)))
+		}
+		// The format instruction is part of this call only, later turns of the session may be free text
+		call := sent
+		if params.ResponseFormat != nil {
+			call = append(slices.Clip(sent), entity.Message{Role: "system", Content: formatInstruction(params.ResponseFormat), Timestamp: nowMilli()})
+		}
+		rslt, err := u.llmSvc.StreamingCall(ctx, call, params, recorder, llmRslt)
+		if len(call) > len(sent) && len(rslt.Messages) >= len(call) {
+			rslt.Messages = slices.Delete(rslt.Messages, len(sent), len(call))
+		}
 		if err != nil {
+			if ctx.Err() != nil {
+				kept := messages
+				if rejected >= 0 {
+					kept = messages[:rejected]
+				}
+				// A cancelled continuation completes the answer it continues
+				at := -1
+				if continued >= originMsgSize && continued < len(kept) {
+					at = continued - originMsgSize
+				}
+				// The failed call still names its provider and carries the usage so far
+				u.saveInterrupted(ctx, sessionID, prompt, arenaID, sendTime, call, kept[originMsgSize:], at, answered, llmRslt, rslt, recorder.Partial(), recorder.PartialReasoning())
+				writer.Send(service.StatusEvent("generation cancelled"))
+				writer.Send(service.DoneEvent())
+				return nil
+			}
 			fmt.Printf("%v", err)
+			// Once the stream started a JSON response is no longer possible
+			if buffer.started {
+				writer.Send(service.ErrorEvent(err))
+				writer.Send(service.DoneEvent())
+				return nil
+			}
 			return err
 		}
+		// update messages, the full history stays in front of the new ones
+		if trimmed > 0 {
+			rslt.Messages = append(slices.Clip(messages), rslt.Messages[len(sent):]...)
+		}
+		llmRslt = rslt
+		messages = llmRslt.Messages
+		recorder.Reset()
 
-		if !llmRslt.IsToolCall {
-			callLLm = false
+		if llmRslt.IsToolCall {
+			continue
+		}
+		if continued >= 0 {
+			messages = mergeContinuation(messages, continued)
+			llmRslt.Messages = messages
+			llmRslt.LlmRes = answered + llmRslt.LlmRes
+			continued = -1
+		}
+
+		// Ask for the rest of an answer cut at max tokens
+		if llmRslt.FinishReason == service.FinishLength {
+			if option.AutoContinue.Enabled && continuations < option.AutoContinue.MaxContinuations && isAnswer(messages) {
+				continuations++
+				// No status event, the continuation streams on as part of the same answer
+				fmt.Printf("answer reached max tokens, continuing %d/%d\n", continuations, option.AutoContinue.MaxContinuations)
+				continued = len(messages) - 1
+				answered = llmRslt.LlmRes
+				messages = append(messages, entity.Message{Role: "user", Content: continuePrompt, Timestamp: nowMilli()})
+				llmRslt.ToolCallDepth = 0
+				continue
+			}
+			writer.Send(service.StatusEvent("answer reached max tokens"))
+		}
+		if llmRslt.FinishReason == service.FinishContentFilter {
+			writer.Send(service.StatusEvent("answer was stopped by the content filter"))
+		}
+
+		// Send an answer that misses the response format back with the errors
+		errs := validateOutput(params.ResponseFormat, llmRslt.LlmRes)
+		if len(errs) == 0 {
+			break
+		}
+		if retries >= maxRetries {
+			fmt.Printf("answer does not match the response format: %v\n", errs)
+			writer.Send(service.StatusEvent("answer does not match the response format"))
 			break
 		}
+		retries++
+		writer.Send(service.StatusEvent(fmt.Sprintf("answer does not match the response format, retry %d/%d", retries, maxRetries)))
+		if rejected < 0 {
+			rejected = len(messages)
+			if isAnswer(messages) {
+				rejected--
+			}
+		}
+		corrected = len(messages)
+		messages = append(messages, entity.Message{Role: "user", Content: correctionPrompt(errs), Timestamp: nowMilli()})
+		llmRslt.ToolCallDepth = 0
 	}
 
+	// Only the final answer is kept, the rejected ones and their corrections are not history
+	if rejected >= 0 {
+		llmRslt.Messages = append(slices.Clip(llmRslt.Messages[:rejected]), llmRslt.Messages[corrected+1:]...)
+	}
+	writer.Send(service.UsageEvent(llmRslt))
+	writer.Send(service.DoneEvent())
+
 	// Update session memory and Record
-	go func() {
-		for i := range llmRslt.Messages {
-			if originMsgSize > i {
-				continue
-			}
-			err := u.sessionRepo.AppendMessage(ctx, sessionID, llmRslt.Messages[i])
-			if err != nil {
-				fmt.Printf("error: %v", err)
+	go u.save(context.WithoutCancel(ctx), sessionID, llmRslt.Messages[originMsgSize:], entity.Record{
+		SessionID:       sessionID,
+		Provider:        llmRslt.Provider,
+		ReqMessage:      prompt,
+		ResMessage:      llmRslt.LlmRes,
+		ReqToken:        llmRslt.ReqToken,
+		ResToken:        llmRslt.ResToken,
+		ReasoningToken:  llmRslt.ReasoningToken,
+		CachedToken:     llmRslt.CachedToken,
+		CacheWriteToken: llmRslt.CacheWriteToken,
+		TokenEstimated:  llmRslt.TokenEstimated,
+		FinishReason:    llmRslt.FinishReason,
+		Continuations:   continuations,
+		ArenaID:         arenaID,
+		SendTime:        sendTime,
+		ReceiveTime:     time.Now(),
+	})
+
+	return nil
+}
+
+// loadImages inlines the stored images of the messages sent upstream, the
+// session itself only keeps their path. An image that can no longer be read
+// is replaced by a note rather than failing every later turn of the session.
+func (u *GenerateUsecase) loadImages(ctx context.Context, messages []entity.Message) {
+	for i, m := range messages {
+		if len(m.Parts) == 0 {
+			continue
+		}
+		parts := make([]entity.ContentPart, len(m.Parts))
+		for j, p := range m.Parts {
+			if p.Type == entity.PartImage && p.Data == "" {
+				data, err := u.imageRepo.Load(ctx, p.Path)
+				if err != nil {
+					fmt.Printf("fail to load image %s: %v\n", p.Path, err)
+					p = entity.ContentPart{Type: entity.PartText, Text: "[image unavailable]"}
+				} else {
+					p.Data = base64.StdEncoding.EncodeToString(data)
+				}
 			}
+			parts[j] = p
+		}
+		messages[i].Parts = parts
+	}
+}
+
+// Resume replays the events of the session's latest turn after lastID, an
+// empty lastID replays all of them, then follows the turn until it ends
+func (u *GenerateUsecase) Resume(ctx context.Context, sessionID, lastID string, writer service.StreamWriter) error {
+	if !u.streamRepo.Exists(ctx, sessionID) {
+		return ErrStreamNotFound
+	}
+	for {
+		events, closed, err := u.streamRepo.Read(ctx, sessionID, lastID)
+		if err != nil || closed {
+			return err
+		}
+		for _, e := range events {
+			writer.Send(service.StreamEvent{ID: e.ID, Type: e.Type, Data: json.RawMessage(e.Data)})
+			lastID = e.ID
 		}
+	}
+}
+
+// History returns every message of the session, including those replaced by summaries
+func (u *GenerateUsecase) History(ctx context.Context, sessionID string) ([]entity.Message, error) {
+	if !u.sessionRepo.ExistKey(ctx, sessionID) {
+		return nil, ErrSessionNotFound
+	}
+	return u.sessionRepo.FetchPrevMessage(ctx, sessionID)
+}
+
+// Cancel stops the in-flight generation of the session, it reports false if none is running
+func (u *GenerateUsecase) Cancel(sessionID string) bool {
+	return u.running.cancel(sessionID)
+}
+
+// saveInterrupted persists what a cancelled generation produced: the finished
+// messages plus the partial answer. failed is the result of the cancelled call,
+// sent its prompt; unless the provider reported them, the prompt and output of
+// that call are estimated. continued is the index in newMsgs of the answer the
+// call was continuing, or -1, answered the text of that answer.
+func (u *GenerateUsecase) saveInterrupted(ctx context.Context, sessionID, prompt, arenaID string, sendTime time.Time, sent, newMsgs []entity.Message, continued int, answered string, llmRslt, failed service.LLMResult, partial, partialReasoning string) {
+	msgs := append([]entity.Message{}, newMsgs...)
+	msgs = append(msgs, entity.Message{
+		Role:             "assistant",
+		Content:          partial,
+		ReasoningContent: partialReasoning,
+		Timestamp:        nowMilli(),
+		Interrupted:      true,
+	})
+	res := partial
+	if continued >= 0 {
+		msgs = mergeContinuation(msgs, continued)
+		res = answered + partial
+	}
+	reasoningToken := approxtoken.Estimate(partialReasoning)
+
+	reqToken := max(failed.ReqToken, llmRslt.ReqToken)
+	if reqToken == llmRslt.ReqToken {
+		reqToken += approxtoken.EstimateMessages(sent) + approxtoken.TokensPerReply
+	}
+	resToken := max(failed.ResToken, llmRslt.ResToken)
+
+	provider := failed.Provider
+	if provider == "" {
+		provider = llmRslt.Provider
+	}
 
-		err := u.logRepo.Insert(sessionID, prompt, llmRslt.LlmRes, llmRslt.ReqToken, llmRslt.ResToken, sendTime, time.Now())
+	go u.save(context.WithoutCancel(ctx), sessionID, msgs, entity.Record{
+		SessionID:       sessionID,
+		Provider:        provider,
+		ReqMessage:      prompt,
+		ResMessage:      res,
+		ReqToken:        reqToken,
+		ResToken:        resToken + approxtoken.Estimate(partial) + reasoningToken,
+		ReasoningToken:  llmRslt.ReasoningToken + reasoningToken,
+		CachedToken:     max(failed.CachedToken, llmRslt.CachedToken),
+		CacheWriteToken: max(failed.CacheWriteToken, llmRslt.CacheWriteToken),
+		TokenEstimated:  true,
+		Interrupted:     true,
+		ArenaID:         arenaID,
+		SendTime:        sendTime,
+		ReceiveTime:     time.Now(),
+	})
+}
 
+// save appends the new messages to the session and inserts the log record
+func (u *GenerateUsecase) save(ctx context.Context, sessionID string, newMsgs []entity.Message, record entity.Record) {
+	for _, msg := range newMsgs {
+		err := u.sessionRepo.AppendMessage(ctx, sessionID, msg)
 		if err != nil {
 			fmt.Printf("error: %v", err)
 		}
-	}()
+	}
 
-	// u.logRepo.Insert(ctx, sessionID, prompt)
-	return nil
+	record.Cost = turnCost(record)
+	err := u.logRepo.Insert(record)
+	if err != nil {
+		fmt.Printf("error: %v", err)
+	}
 }
 
 func nowMilli() string { return fmt.Sprintf("%d", time.Now().UnixMilli()) }
@@ -87,5 +432,5 @@ func nowMilli() string { return fmt.Sprintf("%d", time.Now().UnixMilli()) }
 // }
 //
 // type LogRepository interface {
-//     Insert(sessionId, reqMsg, resMsg string, reqToken, resToken int, sendTime, receiveTime time.Time) error
+//     Insert(record entity.Record) error
 // }
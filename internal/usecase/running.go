@@ -0,0 +1,51 @@
+package usecase
+
+import (
+	"context"
+	"sync"
+)
+
+// runningGenerations tracks the cancel functions of in-flight generations by session
+type runningGenerations struct {
+	mu   sync.Mutex
+	gens map[string]*runningGeneration
+}
+
+type runningGeneration struct {
+	cancel context.CancelFunc
+}
+
+// start derives a cancelable context for the session's generation, the
+// returned stop func releases it once the generation is over
+func (r *runningGenerations) start(ctx context.Context, sessionID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	gen := &runningGeneration{cancel}
+
+	r.mu.Lock()
+	if r.gens == nil {
+		r.gens = map[string]*runningGeneration{}
+	}
+	r.gens[sessionID] = gen
+	r.mu.Unlock()
+
+	return ctx, func() {
+		cancel()
+		r.mu.Lock()
+		// A newer generation of the same session may have replaced ours
+		if r.gens[sessionID] == gen {
+			delete(r.gens, sessionID)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// cancel stops the session's generation, it reports false if none is running
+func (r *runningGenerations) cancel(sessionID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	gen, ok := r.gens[sessionID]
+	if ok {
+		gen.cancel()
+	}
+	return ok
+}
@@ -0,0 +1,38 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/repository"
+	"kepatrick/llm-playground/internal/domain/service"
+)
+
+// streamBuffer keeps every event of a turn in the stream repository, which
+// assigns its id, before passing it to the client. The client may be gone,
+// the turn then goes on and can be resumed from the buffer.
+type streamBuffer struct {
+	service.StreamWriter
+	ctx       context.Context
+	repo      repository.StreamRepository
+	sessionID string
+	started   bool // an event was sent, errors must now go through the stream
+}
+
+func (w *streamBuffer) Send(event service.StreamEvent) error {
+	w.started = true
+
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	stored, err := w.repo.Append(w.ctx, w.sessionID, entity.StreamEvent{Type: event.Type, Data: string(data)})
+	if err != nil {
+		fmt.Printf("fail to buffer stream event: %v\n", err)
+	}
+	event.ID = stored.ID
+
+	w.StreamWriter.Send(event)
+	return nil
+}
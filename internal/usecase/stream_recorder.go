@@ -0,0 +1,41 @@
+package usecase
+
+import (
+	"kepatrick/llm-playground/internal/domain/service"
+	"strings"
+)
+
+// streamRecorder keeps the text written during the current LLM call, so an
+// interrupted answer can still be saved
+type streamRecorder struct {
+	service.StreamWriter
+	builder   strings.Builder
+	reasoning strings.Builder
+}
+
+func (w *streamRecorder) Send(event service.StreamEvent) error {
+	if p, ok := event.Data.(service.TextPayload); ok {
+		switch event.Type {
+		case service.EventToken:
+			w.builder.WriteString(p.Text)
+		case service.EventReasoning:
+			w.reasoning.WriteString(p.Text)
+		}
+	}
+	return w.StreamWriter.Send(event)
+}
+
+// Partial returns the text written since the last Reset
+func (w *streamRecorder) Partial() string {
+	return w.builder.String()
+}
+
+// PartialReasoning returns the reasoning written since the last Reset
+func (w *streamRecorder) PartialReasoning() string {
+	return w.reasoning.String()
+}
+
+func (w *streamRecorder) Reset() {
+	w.builder.Reset()
+	w.reasoning.Reset()
+}
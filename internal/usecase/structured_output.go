@@ -0,0 +1,46 @@
+package usecase
+
+import (
+	"encoding/json"
+	"fmt"
+	"kepatrick/llm-playground/internal/domain/service"
+	"kepatrick/llm-playground/pkg/jsonschema"
+	"strings"
+)
+
+// formatInstruction tells the model about the response format. Providers
+// without a native JSON mode rely on it, and OpenAI's json_object mode
+// requires the word JSON to appear in the messages.
+func formatInstruction(f *service.ResponseFormat) string {
+	if f.Type != "json_schema" {
+		return "Respond with a single JSON object only, without markdown fences or any other text."
+	}
+	schema, _ := json.Marshal(f.Schema)
+	return "Respond with a single JSON value only, without markdown fences or any other text. It must match this JSON schema: " + string(schema)
+}
+
+// validateOutput checks an answer against the response format and returns the
+// violations, none if no format was requested
+func validateOutput(f *service.ResponseFormat, output string) []string {
+	if f == nil {
+		return nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(output)), &value); err != nil {
+		return []string{fmt.Sprintf("answer is not valid JSON: %v", err)}
+	}
+	if f.Type != "json_schema" {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return []string{"answer is not a JSON object"}
+		}
+		return nil
+	}
+	return jsonschema.Validate(f.Schema, value)
+}
+
+// correctionPrompt asks the model to fix an answer that failed validation
+func correctionPrompt(errs []string) string {
+	return "Your previous answer does not match the required format:\n- " + strings.Join(errs, "\n- ") +
+		"\nReply again with only the corrected JSON."
+}
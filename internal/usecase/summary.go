@@ -0,0 +1,165 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"kepatrick/llm-playground/pkg/approxtoken"
+	"strings"
+	"time"
+)
+
+// summaryInstruction is the system prompt of the summarization call
+const summaryInstruction = "You compact chat histories. Summarize the conversation below in a few short paragraphs for the assistant who continues it. " +
+	"Keep names, facts, decisions, open questions and anything the user asked to remember; drop small talk. " +
+	"If an earlier summary is given, merge it into the new one. Reply with the summary only."
+
+// historyView returns the messages sent upstream for a session history: the
+// messages covered by the latest summary are replaced by it, the summary
+// itself follows the leading system prompt
+func historyView(history []entity.Message) []entity.Message {
+	latest := -1
+	for i, m := range history {
+		if m.Summary {
+			latest = i
+		}
+	}
+	if latest < 0 {
+		return history
+	}
+
+	summary := history[latest]
+	summary.Content = "Summary of the earlier conversation:\n" + summary.Content
+
+	head := leadingSystem(history)
+	view := append([]entity.Message{}, history[:head]...)
+	view = append(view, summary)
+	for _, m := range history[history[latest].SummaryOf:] {
+		if !m.Summary {
+			view = append(view, m)
+		}
+	}
+	return view
+}
+
+// compact summarizes the oldest turns of a session whose history exceeds the
+// threshold of options.json, stores the summary in the session and returns
+// the history to send upstream. The summarized messages stay in the session.
+// Compaction is best effort, on failure the history is sent as it is.
+func (u *GenerateUsecase) compact(ctx context.Context, sessionID string, history []entity.Message, writer service.StreamWriter) []entity.Message {
+	view := historyView(history)
+	opt := config.LoadOption().Summarize
+	if !opt.Enabled || opt.ThresholdTokens <= 0 || approxtoken.EstimateMessages(view) <= opt.ThresholdTokens {
+		return view
+	}
+
+	// A new summary takes over the previous one and the messages after it
+	prev := ""
+	start := leadingSystem(history)
+	for _, m := range history {
+		if m.Summary {
+			prev = m.Content
+			start = m.SummaryOf
+		}
+	}
+	// Cut before the user message that starts the oldest kept turn, so tool
+	// calls stay with their results
+	cut := -1
+	kept := 0
+	for i := len(history) - 1; i >= start; i-- {
+		if history[i].Role == "user" && !history[i].Summary {
+			kept++
+			if kept >= max(opt.KeepTurns, 1) {
+				cut = i
+				break
+			}
+		}
+	}
+	if cut <= start {
+		return view
+	}
+
+	writer.Send(service.StatusEvent("summarizing earlier conversation"))
+	content, err := u.summarize(ctx, sessionID, prev, history[start:cut], opt.Api)
+	if err != nil {
+		fmt.Printf("fail to summarize session %s: %v\n", sessionID, err)
+		return view
+	}
+
+	summary := entity.Message{Role: "system", Content: content, Timestamp: nowMilli(), Summary: true, SummaryOf: cut}
+	if err := u.sessionRepo.AppendMessage(ctx, sessionID, summary); err != nil {
+		fmt.Printf("fail to save summary: %v\n", err)
+	}
+	return historyView(append(history, summary))
+}
+
+// summarize asks the llm for a summary of the messages, merged with the
+// previous summary if any, and logs the call as a record of its own
+func (u *GenerateUsecase) summarize(ctx context.Context, sessionID, prev string, msgs []entity.Message, api string) (string, error) {
+	var transcript strings.Builder
+	if prev != "" {
+		fmt.Fprintf(&transcript, "Earlier summary:\n%s\n\nConversation:\n", prev)
+	}
+	for _, m := range msgs {
+		if m.Summary || m.Role == "system" {
+			continue
+		}
+		for _, tc := range m.ToolCalls {
+			fn, _ := tc["function"].(map[string]interface{})
+			fmt.Fprintf(&transcript, "%s called tool %v with %v\n", m.Role, fn["name"], fn["arguments"])
+		}
+		if m.Content != "" {
+			fmt.Fprintf(&transcript, "%s: %s\n", m.Role, m.Content)
+		}
+	}
+
+	sendTime := time.Now()
+	messages := []entity.Message{
+		{Role: "system", Content: summaryInstruction, Timestamp: nowMilli()},
+		{Role: "user", Content: transcript.String(), Timestamp: nowMilli()},
+	}
+	// The transcript may ask for tools, none are offered so none run
+	rslt, err := u.llmSvc.StreamingCall(ctx, messages, service.GenerateParams{Api: api, NoTools: true}, discardWriter{}, service.LLMResult{})
+	if err != nil {
+		return "", err
+	}
+	if rslt.IsToolCall {
+		return "", fmt.Errorf("summary answered with a tool call")
+	}
+	if strings.TrimSpace(rslt.LlmRes) == "" {
+		return "", fmt.Errorf("no summary in the answer")
+	}
+
+	go u.save(context.WithoutCancel(ctx), sessionID, nil, entity.Record{
+		SessionID:       sessionID,
+		Provider:        rslt.Provider,
+		ReqMessage:      "[summary]",
+		ResMessage:      rslt.LlmRes,
+		ReqToken:        rslt.ReqToken,
+		ResToken:        rslt.ResToken,
+		ReasoningToken:  rslt.ReasoningToken,
+		CachedToken:     rslt.CachedToken,
+		CacheWriteToken: rslt.CacheWriteToken,
+		TokenEstimated:  rslt.TokenEstimated,
+		FinishReason:    rslt.FinishReason,
+		SendTime:        sendTime,
+		ReceiveTime:     time.Now(),
+	})
+	return strings.TrimSpace(rslt.LlmRes), nil
+}
+
+// leadingSystem returns the number of system prompt messages that open the history
+func leadingSystem(history []entity.Message) int {
+	head := 0
+	for head < len(history) && history[head].Role == "system" && !history[head].Summary {
+		head++
+	}
+	return head
+}
+
+// discardWriter drops the events of calls whose output is not streamed to the client
+type discardWriter struct{}
+
+func (discardWriter) Send(service.StreamEvent) error { return nil }
@@ -0,0 +1,67 @@
+// Package approxtoken approximates token counts for apis that report no usage,
+// for context budgets and rate limits.
+//
+// It is not a tokenizer: no BPE vocabulary is embedded, text is charged by a
+// character class heuristic calibrated on cl100k averages. Counts can differ
+// from the model's own by a fair margin, more so for code and rare scripts,
+// and other model families tokenize differently altogether. The error has no
+// bound, so counts are never usage: callers keep headroom on budgets and total
+// estimated turns apart from reported ones.
+package approxtoken
+
+import "unicode"
+
+// Average characters per token of BPE vocabularies such as cl100k
+const (
+	charsPerWordToken   = 4
+	digitsPerDigitToken = 3
+)
+
+// Estimate returns the approximate number of tokens of text. Text is split
+// the way BPE tokenizers pre-tokenize it, into runs of letters, digits,
+// whitespace and single symbols, but no merges are applied: each run is
+// charged by the average merge length of its kind. CJK characters rarely
+// merge and count one token each. The result leans towards overestimating,
+// which is the safe side for budgets.
+func Estimate(text string) int {
+	runes := []rune(text)
+	tokens := 0
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		j := i + 1
+		switch {
+		case isCJK(r):
+			tokens++
+		case unicode.IsLetter(r):
+			for j < len(runes) && unicode.IsLetter(runes[j]) && !isCJK(runes[j]) {
+				j++
+			}
+			tokens += ceilDiv(j-i, charsPerWordToken)
+		case unicode.IsDigit(r):
+			for j < len(runes) && unicode.IsDigit(runes[j]) {
+				j++
+			}
+			tokens += ceilDiv(j-i, digitsPerDigitToken)
+		case unicode.IsSpace(r):
+			for j < len(runes) && unicode.IsSpace(runes[j]) {
+				j++
+			}
+			// A single space is merged into the following word
+			if j-i > 1 || r != ' ' {
+				tokens++
+			}
+		default:
+			tokens++
+		}
+		i = j
+	}
+	return tokens
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,40 @@
+package approxtoken
+
+import "kepatrick/llm-playground/internal/domain/entity"
+
+// Token accounting of the chat format: the overhead of every message (role
+// and separators), the tokens that prime the assistant reply, and an image
+const (
+	TokensPerMessage = 4
+	TokensPerReply   = 3
+	TokensPerImage   = 765 // a 1024x1024 image at high detail
+)
+
+// EstimateMessages returns the approximate prompt tokens of the messages,
+// the overhead of every message included
+func EstimateMessages(msgs []entity.Message) int {
+	total := 0
+	for _, m := range msgs {
+		total += EstimateMessage(m) + TokensPerMessage
+	}
+	return total
+}
+
+// EstimateMessage returns the approximate tokens of the content, images and
+// tool calls of a message, without the message overhead. Reasoning is never
+// sent upstream and does not count.
+func EstimateMessage(m entity.Message) int {
+	total := Estimate(m.Content)
+	for _, p := range m.Parts {
+		if p.Type != entity.PartText {
+			total += TokensPerImage
+		}
+	}
+	for _, tc := range m.ToolCalls {
+		fn, _ := tc["function"].(map[string]interface{})
+		name, _ := fn["name"].(string)
+		args, _ := fn["arguments"].(string)
+		total += Estimate(name) + Estimate(args)
+	}
+	return total
+}
@@ -0,0 +1,280 @@
+// Package cassette records HTTP interactions to a file and replays them, so
+// code talking to LLM apis can run offline and deterministically.
+//
+// A cassette is a JSON file of request/response pairs. Requests are matched
+// on method, URL and the normalized JSON body; identical requests are served
+// in the order they were recorded. Request headers, which carry the api keys,
+// are never written. Query parameters that may hold a secret, the api key ones
+// and those named to New, are written as "REDACTED" and matched in that form.
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Mode selects what the transport does with the cassette
+type Mode string
+
+const (
+	ModeOff    Mode = ""       // pass requests through
+	ModeRecord Mode = "record" // pass requests through and write every interaction to the cassette
+	ModeReplay Mode = "replay" // answer from the cassette only, never touch the network
+)
+
+// redacted is what a secret query parameter is recorded as
+const redacted = "REDACTED"
+
+// Query parameters always redacted, Azure and Google take api keys this way
+var secretParams = []string{"api-key", "api_key", "key", "access_token"}
+
+// Response headers worth keeping, the retry policy reads them
+var keptHeaders = []string{"Content-Type", "Retry-After", "X-Ratelimit-", "Anthropic-Ratelimit-"}
+
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method string          `json:"method"`
+	URL    string          `json:"url"`
+	Body   json.RawMessage `json:"body"`
+}
+
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"` // the raw stream, SSE or NDJSON
+}
+
+// Transport is an http.RoundTripper that records to or replays from a cassette file
+type Transport struct {
+	mode   Mode
+	path   string
+	next   http.RoundTripper
+	redact map[string]bool // lower case names of the redacted query parameters
+
+	mu       sync.Mutex
+	cassette Cassette
+	served   map[int]bool // replayed interactions
+}
+
+// New creates a Transport for the cassette at path. Record mode starts an
+// empty cassette that replaces the file, replay mode loads it. next defaults
+// to http.DefaultTransport. The query parameters named by redact are kept
+// out of the cassette along with the api key ones.
+func New(mode Mode, path string, next http.RoundTripper, redact ...string) (*Transport, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	t := &Transport{mode: mode, path: path, next: next, redact: map[string]bool{}, served: map[int]bool{}}
+	for _, name := range append(slices.Clone(secretParams), redact...) {
+		t.redact[strings.ToLower(name)] = true
+	}
+
+	switch mode {
+	case ModeOff, ModeRecord:
+	case ModeReplay:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &t.cassette); err != nil {
+			return nil, fmt.Errorf("cassette %s: %v", path, err)
+		}
+		// Cassettes recorded before a parameter was redacted still match
+		for i := range t.cassette.Interactions {
+			in := &t.cassette.Interactions[i]
+			in.Request.Body = normalize(in.Request.Body)
+			if u, err := url.Parse(in.Request.URL); err == nil {
+				in.Request.URL = t.redactURL(u)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown cassette mode %q", mode)
+	}
+	return t, nil
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.mode == ModeOff {
+		return t.next.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	recorded := Request{Method: req.Method, URL: t.redactURL(req.URL), Body: normalize(body)}
+
+	if t.mode == ModeReplay {
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+		// A miss is answered with a 404, a transport error would look like a
+		// network failure and be retried
+		res, ok := t.replay(recorded)
+		if !ok {
+			res = Response{
+				Status: http.StatusNotFound,
+				Header: http.Header{"Content-Type": {"text/plain"}},
+				Body:   fmt.Sprintf("cassette %s has no interaction for %s %s", t.path, req.Method, recorded.URL),
+			}
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", res.Status, http.StatusText(res.Status)),
+			StatusCode:    res.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        res.Header.Clone(),
+			Body:          io.NopCloser(strings.NewReader(res.Body)),
+			ContentLength: int64(len(res.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	for k, v := range res.Header {
+		if keepHeader(k) {
+			header[k] = v
+		}
+	}
+	res.Body = &recordingBody{ReadCloser: res.Body, done: func(stream []byte) {
+		t.record(Interaction{recorded, Response{Status: res.StatusCode, Header: header, Body: string(stream)}})
+	}}
+	return res, nil
+}
+
+// replay returns the first unserved interaction matching the request, or the
+// last matching one once all were served
+func (t *Transport) replay(req Request) (Response, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last := -1
+	for i, in := range t.cassette.Interactions {
+		if in.Request.Method != req.Method || in.Request.URL != req.URL || !bytes.Equal(in.Request.Body, req.Body) {
+			continue
+		}
+		if !t.served[i] {
+			t.served[i] = true
+			return in.Response, true
+		}
+		last = i
+	}
+	if last < 0 {
+		return Response{}, false
+	}
+	return t.cassette.Interactions[last].Response, true
+}
+
+// record appends the interaction and rewrites the cassette file
+func (t *Transport) record(in Interaction) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.cassette.Interactions = append(t.cassette.Interactions, in)
+	data, err := json.MarshalIndent(t.cassette, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(t.path), 0o755); err == nil {
+			err = os.WriteFile(t.path, data, 0o644)
+		}
+	}
+	if err != nil {
+		fmt.Printf("fail to write cassette %s: %v\n", t.path, err)
+	}
+}
+
+// normalize compacts a JSON body with sorted keys so that formatting and key
+// order do not affect matching, other bodies are kept as a JSON string
+func normalize(body []byte) json.RawMessage {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return json.RawMessage("null")
+	}
+	// Numbers are kept verbatim, a seed may not fit a float64
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err == nil {
+		if out, err := json.Marshal(v); err == nil {
+			return out
+		}
+	}
+	out, _ := json.Marshal(string(body))
+	return out
+}
+
+// redactURL returns the URL with the values of the redacted query parameters
+// replaced, other parameters are left as sent
+func (t *Transport) redactURL(u *url.URL) string {
+	q := u.Query()
+	changed := false
+	for name := range q {
+		if t.redact[strings.ToLower(name)] {
+			q[name] = []string{redacted}
+			changed = true
+		}
+	}
+	if !changed {
+		return u.String()
+	}
+	r := *u
+	r.RawQuery = q.Encode()
+	return r.String()
+}
+
+func keepHeader(name string) bool {
+	for _, k := range keptHeaders {
+		if name == k || (strings.HasSuffix(k, "-") && strings.HasPrefix(name, k)) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordingBody captures the stream as the client reads it and hands it over
+// once, at the end of the stream or when the client closes it early
+type recordingBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	done func([]byte)
+	once sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.once.Do(func() { b.done(b.buf.Bytes()) })
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	b.once.Do(func() { b.done(b.buf.Bytes()) })
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,186 @@
+package cassette_test
+
+import (
+	"context"
+	"io"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"kepatrick/llm-playground/internal/infra/llm"
+	"kepatrick/llm-playground/pkg/cassette"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const apiKey = "sk-test-secret"
+
+// openAIStream answers with a short chat completions stream ending in usage
+const openAIStream = "data: {\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":\"Hi\"}}]}\n\n" +
+	"data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n" +
+	"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":1}}\n\n" +
+	"data: [DONE]\n\n"
+
+// call sends the prompt through an OpenAILLMService using the transport
+func call(t *testing.T, transport http.RoundTripper, url, prompt string) (service.LLMResult, error) {
+	t.Helper()
+	svc := llm.NewOpenAILLMService(apiKey, url, "gpt-4o-mini", &http.Client{Transport: transport}, nil, true, llm.AuthBearer)
+	return svc.StreamingCall(context.Background(), []entity.Message{{Role: "user", Content: prompt}}, service.GenerateParams{}, discard{}, service.LLMResult{})
+}
+
+func TestRecordReplay(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Authorization") != "Bearer "+apiKey {
+			t.Errorf("Authorization = %q, the key must still reach the api", r.Header.Get("Authorization"))
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Set-Cookie", "session=abc")
+		io.WriteString(w, openAIStream)
+	}))
+	url := srv.URL + "/v1/chat/completions"
+	path := filepath.Join(t.TempDir(), "cassettes", "chat.json")
+
+	rec, err := cassette.New(cassette.ModeRecord, path, nil)
+	if err != nil {
+		t.Fatalf("New record: %v", err)
+	}
+	recorded, err := call(t, rec, url, "Say hi")
+	if err != nil {
+		t.Fatalf("record call: %v", err)
+	}
+	srv.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read cassette: %v", err)
+	}
+	for _, secret := range []string{apiKey, "Authorization", "Set-Cookie"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("cassette contains %q:\n%s", secret, data)
+		}
+	}
+
+	// The server is gone, every answer comes from the file
+	rep, err := cassette.New(cassette.ModeReplay, path, nil)
+	if err != nil {
+		t.Fatalf("New replay: %v", err)
+	}
+	replayed, err := call(t, rep, url, "Say hi")
+	if err != nil {
+		t.Fatalf("replay call: %v", err)
+	}
+	if replayed.LlmRes != recorded.LlmRes || replayed.ReqToken != recorded.ReqToken || replayed.ResToken != recorded.ResToken || replayed.FinishReason != recorded.FinishReason {
+		t.Errorf("replayed %+v, recorded %+v", replayed, recorded)
+	}
+	if replayed.LlmRes != "Hi" || replayed.ReqToken != 5 || replayed.ResToken != 1 {
+		t.Errorf("replayed answer %q tokens %d/%d, want %q 5/1", replayed.LlmRes, replayed.ReqToken, replayed.ResToken, "Hi")
+	}
+	if calls != 1 {
+		t.Errorf("api called %d times, want 1", calls)
+	}
+
+	// Another prompt is a miss, answered with a 404 rather than a network error
+	if _, err := call(t, rep, url, "Say bye"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("miss err = %v, want a 404", err)
+	}
+}
+
+func TestRecordRedactsQuery(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("api-key") != apiKey || r.URL.Query().Get("tenant") != "t-secret" {
+			t.Errorf("query = %q, the parameters must still reach the api", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, openAIStream)
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "chat.json")
+
+	rec, err := cassette.New(cassette.ModeRecord, path, nil, "tenant")
+	if err != nil {
+		t.Fatalf("New record: %v", err)
+	}
+	if _, err := call(t, rec, srv.URL+"/v1/chat/completions?api-version=2024-10-21&api-key="+apiKey+"&tenant=t-secret", "Say hi"); err != nil {
+		t.Fatalf("record call: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read cassette: %v", err)
+	}
+	for _, secret := range []string{apiKey, "t-secret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("cassette contains %q:\n%s", secret, data)
+		}
+	}
+	if !strings.Contains(string(data), "api-version=2024-10-21") {
+		t.Errorf("cassette lost the plain parameters:\n%s", data)
+	}
+
+	// The redacted form matches whatever the secrets are on replay
+	rep, err := cassette.New(cassette.ModeReplay, path, nil, "tenant")
+	if err != nil {
+		t.Fatalf("New replay: %v", err)
+	}
+	if _, err := call(t, rep, srv.URL+"/v1/chat/completions?api-version=2024-10-21&api-key=other&tenant=other", "Say hi"); err != nil {
+		t.Errorf("replay call: %v", err)
+	}
+}
+
+func TestReplayMatching(t *testing.T) {
+	const url = "https://api.openai.com/v1/chat/completions"
+	const body = `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"Say hello"}],"stream":true,"stream_options":{"include_usage":true}}`
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		status int
+	}{
+		{"same request", "POST", url, body, http.StatusOK},
+		{"reordered and indented body", "POST", url, "{\n  \"stream\": true,\n  \"stream_options\": {\"include_usage\": true},\n  \"messages\": [{\"content\": \"Say hello\", \"role\": \"user\"}],\n  \"model\": \"gpt-4o-mini\"\n}", http.StatusOK},
+		{"other method", "PUT", url, body, http.StatusNotFound},
+		{"other url", "POST", url + "?api-version=1", body, http.StatusNotFound},
+		{"other body", "POST", url, strings.Replace(body, "Say hello", "Say bye", 1), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rep, err := cassette.New(cassette.ModeReplay, "testdata/openai_stream.json", nil)
+			if err != nil {
+				t.Fatalf("New replay: %v", err)
+			}
+			req, _ := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			res, err := rep.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip: %v", err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestReplayCassetteFile(t *testing.T) {
+	rep, err := cassette.New(cassette.ModeReplay, "testdata/openai_stream.json", nil)
+	if err != nil {
+		t.Fatalf("New replay: %v", err)
+	}
+	rslt, err := call(t, rep, "https://api.openai.com/v1/chat/completions", "Say hello")
+	if err != nil {
+		t.Fatalf("replay call: %v", err)
+	}
+	if rslt.LlmRes != "Hello there!" || rslt.ReqToken != 9 || rslt.ResToken != 3 || rslt.FinishReason != service.FinishStop {
+		t.Errorf("answer %q tokens %d/%d finish %q, want %q 9/3 stop", rslt.LlmRes, rslt.ReqToken, rslt.ResToken, rslt.FinishReason, "Hello there!")
+	}
+}
+
+type discard struct{}
+
+func (discard) Send(service.StreamEvent) error { return nil }
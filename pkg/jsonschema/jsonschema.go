@@ -0,0 +1,309 @@
+// Package jsonschema validates decoded JSON values against a JSON Schema.
+//
+// It covers the keywords used to describe structured LLM output: type, enum,
+// const, properties, required, additionalProperties, items, the numeric,
+// string and array bounds, pattern, allOf/anyOf/oneOf, and local $ref to
+// "#/$defs/..." or "#/definitions/...", which may lead to further references
+// and describe recursive structures.
+package jsonschema
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validate checks value, as produced by encoding/json, against schema and
+// returns one message per violation, each prefixed with the JSON path
+func Validate(schema map[string]interface{}, value interface{}) []string {
+	v := &validator{root: schema, active: map[string]bool{}}
+	v.validate(schema, value, "$")
+	return v.errs
+}
+
+type validator struct {
+	root   map[string]interface{}
+	errs   []string
+	active map[string]bool // references being followed, by path and $ref
+}
+
+func (v *validator) fail(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *validator) validate(schema map[string]interface{}, value interface{}, path string) {
+	if ref, ok := schema["$ref"].(string); ok {
+		// Following a reference again at the same path, through a chain of
+		// references or the combinators, would never end
+		key := path + " " + ref
+		if v.active[key] {
+			v.fail(path, "circular $ref %q", ref)
+			return
+		}
+		target, err := v.resolve(ref)
+		if err != nil {
+			v.fail(path, "%v", err)
+			return
+		}
+		v.active[key] = true
+		defer delete(v.active, key)
+		v.validate(target, value, path)
+		return
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		v.fail(path, "expected %s, got %s", typeNames(t), typeOf(value))
+		return
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && !containsValue(enum, value) {
+		v.fail(path, "value must be one of %v", enum)
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, value) {
+		v.fail(path, "value must be %v", c)
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		v.validateObject(schema, val, path)
+	case []interface{}:
+		v.validateArray(schema, val, path)
+	case string:
+		v.validateString(schema, val, path)
+	case float64:
+		v.validateNumber(schema, val, path)
+	}
+
+	v.validateCombinators(schema, value, path)
+}
+
+func (v *validator) validateObject(schema, obj map[string]interface{}, path string) {
+	if req, ok := schema["required"].([]interface{}); ok {
+		for _, r := range req {
+			name, _ := r.(string)
+			if _, ok := obj[name]; !ok {
+				v.fail(path, "missing required property %q", name)
+			}
+		}
+	}
+
+	props, _ := schema["properties"].(map[string]interface{})
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if ps, ok := props[k].(map[string]interface{}); ok {
+			v.validate(ps, obj[k], path+"."+k)
+			continue
+		}
+		switch ap := schema["additionalProperties"].(type) {
+		case bool:
+			if !ap {
+				v.fail(path, "unexpected property %q", k)
+			}
+		case map[string]interface{}:
+			v.validate(ap, obj[k], path+"."+k)
+		}
+	}
+
+	if n, ok := number(schema["minProperties"]); ok && float64(len(obj)) < n {
+		v.fail(path, "expected at least %v properties", n)
+	}
+	if n, ok := number(schema["maxProperties"]); ok && float64(len(obj)) > n {
+		v.fail(path, "expected at most %v properties", n)
+	}
+}
+
+func (v *validator) validateArray(schema map[string]interface{}, arr []interface{}, path string) {
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		for i, item := range arr {
+			v.validate(items, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+	if n, ok := number(schema["minItems"]); ok && float64(len(arr)) < n {
+		v.fail(path, "expected at least %v items", n)
+	}
+	if n, ok := number(schema["maxItems"]); ok && float64(len(arr)) > n {
+		v.fail(path, "expected at most %v items", n)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range arr {
+			for j := i + 1; j < len(arr); j++ {
+				if reflect.DeepEqual(arr[i], arr[j]) {
+					v.fail(path, "items %d and %d are equal", i, j)
+				}
+			}
+		}
+	}
+}
+
+func (v *validator) validateString(schema map[string]interface{}, s, path string) {
+	length := float64(utf8.RuneCountInString(s))
+	if n, ok := number(schema["minLength"]); ok && length < n {
+		v.fail(path, "expected at least %v characters", n)
+	}
+	if n, ok := number(schema["maxLength"]); ok && length > n {
+		v.fail(path, "expected at most %v characters", n)
+	}
+	if p, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			v.fail(path, "invalid pattern %q in schema", p)
+		} else if !re.MatchString(s) {
+			v.fail(path, "value does not match pattern %q", p)
+		}
+	}
+}
+
+func (v *validator) validateNumber(schema map[string]interface{}, f float64, path string) {
+	if n, ok := number(schema["minimum"]); ok && f < n {
+		v.fail(path, "value must be >= %v", n)
+	}
+	if n, ok := number(schema["maximum"]); ok && f > n {
+		v.fail(path, "value must be <= %v", n)
+	}
+	if n, ok := number(schema["exclusiveMinimum"]); ok && f <= n {
+		v.fail(path, "value must be > %v", n)
+	}
+	if n, ok := number(schema["exclusiveMaximum"]); ok && f >= n {
+		v.fail(path, "value must be < %v", n)
+	}
+	if n, ok := number(schema["multipleOf"]); ok && n > 0 {
+		if q := f / n; math.Abs(q-math.Round(q)) > 1e-9 {
+			v.fail(path, "value must be a multiple of %v", n)
+		}
+	}
+}
+
+func (v *validator) validateCombinators(schema map[string]interface{}, value interface{}, path string) {
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, s := range all {
+			if sub, ok := s.(map[string]interface{}); ok {
+				v.validate(sub, value, path)
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok && v.countMatches(anyOf, value, path) == 0 {
+		v.fail(path, "value matches none of anyOf")
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		if n := v.countMatches(oneOf, value, path); n != 1 {
+			v.fail(path, "value must match exactly one of oneOf, matched %d", n)
+		}
+	}
+}
+
+// countMatches returns how many of the subschemas accept value
+func (v *validator) countMatches(schemas []interface{}, value interface{}, path string) int {
+	matches := 0
+	for _, s := range schemas {
+		sub, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		probe := &validator{root: v.root, active: v.active}
+		probe.validate(sub, value, path)
+		if len(probe.errs) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+// resolve looks up a local reference such as "#/$defs/address"
+func (v *validator) resolve(ref string) (map[string]interface{}, error) {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+	var node interface{} = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		node = m[part]
+	}
+	schema, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unresolvable $ref %q", ref)
+	}
+	return schema, nil
+}
+
+func matchesType(t interface{}, value interface{}) bool {
+	switch tt := t.(type) {
+	case string:
+		return isType(tt, value)
+	case []interface{}:
+		for _, x := range tt {
+			if name, ok := x.(string); ok && isType(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isType(name string, value interface{}) bool {
+	switch name {
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return typeOf(value) == name
+	}
+}
+
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func typeNames(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		names := make([]string, 0, len(list))
+		for _, x := range list {
+			names = append(names, fmt.Sprint(x))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func containsValue(list []interface{}, value interface{}) bool {
+	for _, x := range list {
+		if reflect.DeepEqual(x, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func number(x interface{}) (float64, bool) {
+	f, ok := x.(float64)
+	return f, ok
+}
@@ -0,0 +1,173 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		want   []string
+	}{
+		{
+			name:   "valid object",
+			schema: `{"type":"object","properties":{"sentiment":{"type":"string","enum":["positive","negative"]},"confidence":{"type":"number","minimum":0,"maximum":1}},"required":["sentiment","confidence"],"additionalProperties":false}`,
+			value:  `{"sentiment":"positive","confidence":0.9}`,
+		},
+		{
+			name:   "wrong root type",
+			schema: `{"type":"object"}`,
+			value:  `[1,2]`,
+			want:   []string{"$: expected object, got array"},
+		},
+		{
+			name:   "missing required and unexpected property",
+			schema: `{"type":"object","properties":{"a":{"type":"string"}},"required":["a"],"additionalProperties":false}`,
+			value:  `{"b":1}`,
+			want:   []string{`$: missing required property "a"`, `$: unexpected property "b"`},
+		},
+		{
+			name:   "additionalProperties schema",
+			schema: `{"type":"object","additionalProperties":{"type":"integer"}}`,
+			value:  `{"x":1,"y":1.5}`,
+			want:   []string{"$.y: expected integer, got number"},
+		},
+		{
+			name:   "nested path",
+			schema: `{"type":"object","properties":{"items":{"type":"array","items":{"type":"object","properties":{"n":{"type":"number","maximum":10}}}}}}`,
+			value:  `{"items":[{"n":1},{"n":11}]}`,
+			want:   []string{"$.items[1].n: value must be <= 10"},
+		},
+		{
+			name:   "enum and const",
+			schema: `{"type":"object","properties":{"e":{"enum":["a","b"]},"c":{"const":3}}}`,
+			value:  `{"c":4,"e":"z"}`,
+			want:   []string{"$.c: value must be 3", "$.e: value must be one of [a b]"},
+		},
+		{
+			name:   "nullable type list",
+			schema: `{"type":["string","null"]}`,
+			value:  `null`,
+		},
+		{
+			name:   "type list mismatch",
+			schema: `{"type":["string","null"]}`,
+			value:  `true`,
+			want:   []string{"$: expected string or null, got boolean"},
+		},
+		{
+			name:   "string bounds and pattern",
+			schema: `{"type":"string","minLength":2,"maxLength":3,"pattern":"^[a-z]+$"}`,
+			value:  `"ABCD"`,
+			want:   []string{"$: expected at most 3 characters", `$: value does not match pattern "^[a-z]+$"`},
+		},
+		{
+			name:   "length counts runes",
+			schema: `{"type":"string","maxLength":2}`,
+			value:  `"好的"`,
+		},
+		{
+			name:   "exclusive bounds and multipleOf",
+			schema: `{"type":"number","exclusiveMinimum":0,"multipleOf":0.5}`,
+			value:  `0`,
+			want:   []string{"$: value must be > 0"},
+		},
+		{
+			name:   "not a multiple",
+			schema: `{"type":"number","multipleOf":0.5}`,
+			value:  `0.7`,
+			want:   []string{"$: value must be a multiple of 0.5"},
+		},
+		{
+			name:   "array bounds and unique items",
+			schema: `{"type":"array","minItems":1,"maxItems":2,"uniqueItems":true}`,
+			value:  `[1,1,2]`,
+			want:   []string{"$: expected at most 2 items", "$: items 0 and 1 are equal"},
+		},
+		{
+			name:   "anyOf matches one",
+			schema: `{"anyOf":[{"type":"string"},{"type":"number"}]}`,
+			value:  `1`,
+		},
+		{
+			name:   "anyOf matches none",
+			schema: `{"anyOf":[{"type":"string"},{"type":"number"}]}`,
+			value:  `true`,
+			want:   []string{"$: value matches none of anyOf"},
+		},
+		{
+			name:   "oneOf matches two",
+			schema: `{"oneOf":[{"type":"number"},{"type":"integer"}]}`,
+			value:  `2`,
+			want:   []string{"$: value must match exactly one of oneOf, matched 2"},
+		},
+		{
+			name:   "allOf",
+			schema: `{"allOf":[{"type":"number"},{"minimum":5}]}`,
+			value:  `3`,
+			want:   []string{"$: value must be >= 5"},
+		},
+		{
+			name:   "local ref",
+			schema: `{"type":"object","properties":{"home":{"$ref":"#/$defs/address"}},"$defs":{"address":{"type":"object","required":["city"]}}}`,
+			value:  `{"home":{}}`,
+			want:   []string{`$.home: missing required property "city"`},
+		},
+		{
+			name:   "ref to a ref",
+			schema: `{"$ref":"#/$defs/id","$defs":{"id":{"$ref":"#/$defs/positive"},"positive":{"type":"integer","minimum":1}}}`,
+			value:  `0`,
+			want:   []string{"$: value must be >= 1"},
+		},
+		{
+			name:   "recursive schema",
+			schema: `{"$ref":"#/$defs/node","$defs":{"node":{"type":"object","required":["name"],"properties":{"name":{"type":"string"},"children":{"type":"array","items":{"$ref":"#/$defs/node"}}}}}}`,
+			value:  `{"name":"root","children":[{"name":"a","children":[{"children":[]}]}]}`,
+			want:   []string{`$.children[0].children[0]: missing required property "name"`},
+		},
+		{
+			name:   "circular ref chain",
+			schema: `{"$ref":"#/$defs/a","$defs":{"a":{"$ref":"#/$defs/b"},"b":{"$ref":"#/$defs/a"}}}`,
+			value:  `1`,
+			want:   []string{`$: circular $ref "#/$defs/a"`},
+		},
+		{
+			name:   "circular ref through allOf",
+			schema: `{"$ref":"#/$defs/a","$defs":{"a":{"allOf":[{"$ref":"#/$defs/a"}]}}}`,
+			value:  `1`,
+			want:   []string{`$: circular $ref "#/$defs/a"`},
+		},
+		{
+			name:   "unresolvable ref",
+			schema: `{"$ref":"#/$defs/missing"}`,
+			value:  `1`,
+			want:   []string{`$: unresolvable $ref "#/$defs/missing"`},
+		},
+		{
+			name:   "remote ref",
+			schema: `{"$ref":"http://example.com/schema.json"}`,
+			value:  `1`,
+			want:   []string{`$: unsupported $ref "http://example.com/schema.json"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var schema map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.schema), &schema); err != nil {
+				t.Fatalf("schema: %v", err)
+			}
+			var value interface{}
+			if err := json.Unmarshal([]byte(tt.value), &value); err != nil {
+				t.Fatalf("value: %v", err)
+			}
+			got := Validate(schema, value)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
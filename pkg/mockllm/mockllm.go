@@ -0,0 +1,182 @@
+// Package mockllm is a scripted OpenAI compatible /chat/completions server for
+// development and tests. Replies are streamed from the scenarios of a Script:
+// text, reasoning, fragmented and parallel tool calls, usage, mid-stream
+// errors, slow tokens, error statuses and dropped connections.
+//
+// Mount Server with httptest.NewServer for in-process use, or run cmd/mockllm.
+package mockllm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Server answers chat completions requests from a Script
+type Server struct {
+	script Script
+
+	mu   sync.Mutex
+	hits map[int]int // matched requests per scenario
+	seq  int
+}
+
+// NewServer creates a Server for the script
+func NewServer(script Script) *Server {
+	return &Server{script: script, hits: map[int]int{}}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req chatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "invalid JSON body: "+err.Error())
+		return
+	}
+
+	sc, id, ok := s.pick(req)
+	if !ok {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "no scenario matches the request")
+		return
+	}
+
+	for k, v := range sc.Headers {
+		w.Header().Set(k, v)
+	}
+	if sc.Status != 0 && sc.Status != http.StatusOK {
+		if sc.Body != "" {
+			w.WriteHeader(sc.Status)
+			w.Write([]byte(sc.Body))
+			return
+		}
+		writeError(w, sc.Status, "mock_error", fmt.Sprintf("scenario %s failed with status %d", sc.Name, sc.Status))
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	created := time.Now().Unix()
+	for _, step := range sc.Steps {
+		delay := sc.DelayMs
+		if step.DelayMs > 0 {
+			delay = step.DelayMs
+		}
+		if delay > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Duration(delay) * time.Millisecond):
+			}
+		}
+
+		if step.Disconnect {
+			// Aborts the response and closes the connection without a clean end
+			panic(http.ErrAbortHandler)
+		}
+		data := step.Raw
+		if data == "" {
+			chunk, _ := json.Marshal(buildChunk(step, id, req.Model, created))
+			data = string(chunk)
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if !sc.NoDone {
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}
+}
+
+// pick returns the first scenario matching the request whose Times is not used up
+func (s *Server) pick(req chatRequest) (Scenario, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	id := fmt.Sprintf("chatcmpl-mock-%d", s.seq)
+	for i, sc := range s.script.Scenarios {
+		if !sc.Match.matches(req) || (sc.Times > 0 && s.hits[i] >= sc.Times) {
+			continue
+		}
+		s.hits[i]++
+		return sc, id, true
+	}
+	return Scenario{}, id, false
+}
+
+// buildChunk returns the chat.completion.chunk of a step, usage and errors are chunks of their own
+func buildChunk(step Step, id, model string, created int64) map[string]interface{} {
+	if step.Error != nil {
+		return map[string]interface{}{"error": step.Error}
+	}
+	chunk := map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion.chunk",
+		"created": created,
+		"model":   model,
+		"choices": []interface{}{},
+	}
+	if step.Usage != nil {
+		chunk["usage"] = map[string]interface{}{
+			"prompt_tokens":     step.Usage.PromptTokens,
+			"completion_tokens": step.Usage.CompletionTokens,
+			"total_tokens":      step.Usage.PromptTokens + step.Usage.CompletionTokens,
+			"completion_tokens_details": map[string]int{
+				"reasoning_tokens": step.Usage.ReasoningTokens,
+			},
+			"prompt_tokens_details": map[string]int{
+				"cached_tokens": step.Usage.CachedTokens,
+			},
+		}
+		return chunk
+	}
+
+	delta := map[string]interface{}{}
+	if step.Content != "" {
+		delta["content"] = step.Content
+	}
+	if step.Reasoning != "" {
+		delta["reasoning_content"] = step.Reasoning
+	}
+	if len(step.ToolCalls) > 0 {
+		calls := make([]map[string]interface{}, 0, len(step.ToolCalls))
+		for _, tc := range step.ToolCalls {
+			fn := map[string]interface{}{"arguments": tc.Arguments}
+			call := map[string]interface{}{"index": tc.Index, "function": fn}
+			if tc.ID != "" {
+				call["id"] = tc.ID
+				call["type"] = "function"
+			}
+			if tc.Name != "" {
+				fn["name"] = tc.Name
+			}
+			calls = append(calls, call)
+		}
+		delta["tool_calls"] = calls
+	}
+
+	var finish interface{}
+	if step.FinishReason != "" {
+		finish = step.FinishReason
+	}
+	chunk["choices"] = []interface{}{map[string]interface{}{"index": 0, "delta": delta, "finish_reason": finish}}
+	return chunk
+}
+
+// writeError answers with an OpenAI style error object
+func writeError(w http.ResponseWriter, status int, typ, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"type": typ, "message": msg},
+	})
+}
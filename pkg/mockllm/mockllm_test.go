@@ -0,0 +1,191 @@
+package mockllm_test
+
+import (
+	"context"
+	"io"
+	"kepatrick/llm-playground/internal/config"
+	"kepatrick/llm-playground/internal/domain/entity"
+	"kepatrick/llm-playground/internal/domain/service"
+	"kepatrick/llm-playground/internal/infra/llm"
+	"kepatrick/llm-playground/pkg/mockllm"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// mockChain serves the scenarios of configs/mockllm with a fresh server and
+// returns the decorator chain main builds for an api pointing at it, with
+// the number of requests the server received
+func mockChain(t *testing.T) (service.LLMService, *atomic.Int32) {
+	t.Helper()
+	script, err := mockllm.LoadScript("../../configs/mockllm/scenarios.json")
+	if err != nil {
+		t.Fatalf("LoadScript: %v", err)
+	}
+	mock := mockllm.NewServer(script)
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		mock.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := config.ApiConfig{
+		ApiUrl:       srv.URL + "/v1/chat/completions",
+		Model:        "mock",
+		IncludeUsage: true,
+		Retry:        config.RetryConfig{MaxAttempts: 3, BaseDelayMs: 10},
+	}
+	svc := llm.NewLLMService("mock", cfg, http.DefaultClient, nil, nil)
+	providers := map[string]service.LLMService{"mock": llm.NewCircuitBreakerLLMService("mock", svc, cfg.CircuitBreaker)}
+	return llm.NewFallbackLLMService(providers, []string{"mock"}), &requests
+}
+
+func ask(chain service.LLMService, prompt string, w service.StreamWriter) (service.LLMResult, error) {
+	msgs := []entity.Message{{Role: "user", Content: prompt}}
+	return chain.StreamingCall(context.Background(), msgs, service.GenerateParams{}, w, service.LLMResult{})
+}
+
+func TestScenarios(t *testing.T) {
+	tests := []struct {
+		name     string
+		prompt   string
+		requests int32
+		check    func(t *testing.T, rslt service.LLMResult, err error, w *eventRecorder)
+	}{
+		{
+			name:     "parallel tool calls",
+			prompt:   "run these in parallel",
+			requests: 1,
+			check: func(t *testing.T, rslt service.LLMResult, err error, w *eventRecorder) {
+				if err != nil {
+					t.Fatalf("StreamingCall: %v", err)
+				}
+				if !rslt.IsToolCall || rslt.Provider != "mock" {
+					t.Errorf("IsToolCall = %v, Provider = %q, want a tool call by mock", rslt.IsToolCall, rslt.Provider)
+				}
+				// the scenario sends no usage, the chain estimates it
+				if !rslt.TokenEstimated || rslt.ReqToken == 0 {
+					t.Errorf("tokens %d estimated %v, want an estimate", rslt.ReqToken, rslt.TokenEstimated)
+				}
+				if len(rslt.Messages) != 4 {
+					t.Fatalf("got %d messages, want user, assistant and two tool results", len(rslt.Messages))
+				}
+				want := []string{`{"language":"en"}`, `{"language":"zh"}`}
+				calls := rslt.Messages[1].ToolCalls
+				if len(calls) != len(want) {
+					t.Fatalf("got %d tool calls, want %d", len(calls), len(want))
+				}
+				for i, tc := range calls {
+					fn, _ := tc["function"].(map[string]interface{})
+					if fn["arguments"] != want[i] {
+						t.Errorf("tool call %d arguments = %v, want %s", i, fn["arguments"], want[i])
+					}
+					if rslt.Messages[2+i].ToolCallID != tc["id"] {
+						t.Errorf("tool result %d answers %q, want %v", i, rslt.Messages[2+i].ToolCallID, tc["id"])
+					}
+				}
+			},
+		},
+		{
+			name:     "429 with Retry-After is retried",
+			prompt:   "retry please",
+			requests: 3,
+			check: func(t *testing.T, rslt service.LLMResult, err error, w *eventRecorder) {
+				if err != nil {
+					t.Fatalf("StreamingCall: %v", err)
+				}
+				if rslt.LlmRes == "" {
+					t.Errorf("got no answer after the retries")
+				}
+				if n := w.count(service.EventStatus); n != 2 {
+					t.Errorf("got %d retry status events, want 2", n)
+				}
+			},
+		},
+		{
+			name:     "error mid-stream",
+			prompt:   "midfail",
+			requests: 1,
+			check: func(t *testing.T, rslt service.LLMResult, err error, w *eventRecorder) {
+				if err == nil || !strings.Contains(err.Error(), "mock failure mid-stream") {
+					t.Errorf("err = %v, want the mid-stream error", err)
+				}
+				if w.text() != "Starting the answer" {
+					t.Errorf("streamed %q before the error", w.text())
+				}
+				if rslt.Provider != "mock" {
+					t.Errorf("Provider = %q, want mock", rslt.Provider)
+				}
+			},
+		},
+		{
+			name:     "disconnect is an unexpected EOF",
+			prompt:   "disconnect",
+			requests: 1,
+			check: func(t *testing.T, rslt service.LLMResult, err error, w *eventRecorder) {
+				if !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Errorf("err = %v, want an unexpected EOF", err)
+				}
+				if w.text() != "The connection drops after this" {
+					t.Errorf("streamed %q before the disconnect", w.text())
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			chain, requests := mockChain(t)
+			w := &eventRecorder{}
+			rslt, err := ask(chain, tt.prompt, w)
+			tt.check(t, rslt, err, w)
+			if n := requests.Load(); n != tt.requests {
+				t.Errorf("server got %d requests, want %d", n, tt.requests)
+			}
+		})
+	}
+}
+
+// eventRecorder is a StreamWriter keeping every event it is sent
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []service.StreamEvent
+}
+
+func (w *eventRecorder) Send(event service.StreamEvent) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.events = append(w.events, event)
+	return nil
+}
+
+func (w *eventRecorder) count(eventType string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := 0
+	for _, e := range w.events {
+		if e.Type == eventType {
+			n++
+		}
+	}
+	return n
+}
+
+// text returns the answer streamed as token events
+func (w *eventRecorder) text() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var b strings.Builder
+	for _, e := range w.events {
+		if p, ok := e.Data.(service.TextPayload); ok && e.Type == service.EventToken {
+			b.WriteString(p.Text)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,138 @@
+package mockllm
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// Script is a scenario file, requests are answered by the first matching scenario
+type Script struct {
+	Scenarios []Scenario `json:"scenarios"`
+}
+
+// Scenario is one scripted reply
+type Scenario struct {
+	Name  string `json:"name"`
+	Match Match  `json:"match"`
+	// Times limits the scenario to its first matching requests, 0 is unlimited
+	Times int `json:"times"`
+
+	// Status other than 200 answers with a plain error response, e.g. 429 or 503
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"` // e.g. Retry-After
+	Body    string            `json:"body"`    // error response body, an OpenAI error object by default
+
+	DelayMs int    `json:"delayMs"` // wait before every step, for slow token streams
+	Steps   []Step `json:"steps"`
+	NoDone  bool   `json:"noDone"` // end the stream without data: [DONE]
+}
+
+// Match selects the requests of a scenario, empty fields match anything
+type Match struct {
+	Contains       string `json:"contains"`       // substring of the last user message
+	LastRole       string `json:"lastRole"`       // role of the last message, "tool" after tool results
+	Model          string `json:"model"`          // requested model
+	ResponseFormat *bool  `json:"responseFormat"` // whether response_format is set
+}
+
+// Step is one chunk of the stream, or a disconnect
+type Step struct {
+	Content      string          `json:"content"`
+	Reasoning    string          `json:"reasoning"`
+	ToolCalls    []ToolCallDelta `json:"toolCalls"`
+	FinishReason string          `json:"finishReason"`
+	Usage        *Usage          `json:"usage"`
+	Error        *StreamError    `json:"error"`
+	Raw          string          `json:"raw"`        // sent as the data of the event, e.g. a malformed chunk
+	Disconnect   bool            `json:"disconnect"` // drop the connection
+	DelayMs      int             `json:"delayMs"`    // wait before this step, overrides the scenario delay
+}
+
+// ToolCallDelta is a tool call fragment, the id and name open a call and the
+// arguments of later fragments with the same index are appended to it
+type ToolCallDelta struct {
+	Index     int    `json:"index"`
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+	ReasoningTokens  int `json:"reasoningTokens"`
+	CachedTokens     int `json:"cachedTokens"` // part of PromptTokens
+}
+
+type StreamError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// LoadScript reads a scenario file
+func LoadScript(path string) (Script, error) {
+	var script Script
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return script, err
+	}
+	err = json.Unmarshal(data, &script)
+	return script, err
+}
+
+// chatRequest is the part of a chat completions request scenarios match on
+type chatRequest struct {
+	Model          string          `json:"model"`
+	Messages       []chatMessage   `json:"messages"`
+	ResponseFormat json.RawMessage `json:"response_format"`
+}
+
+type chatMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"` // a string, or an array of content parts
+}
+
+// text returns the text of a message, joining the text parts of an array content
+func (m chatMessage) text() string {
+	var s string
+	if err := json.Unmarshal(m.Content, &s); err == nil {
+		return s
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	json.Unmarshal(m.Content, &parts)
+	var texts []string
+	for _, p := range parts {
+		if p.Type == "text" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+func (m Match) matches(req chatRequest) bool {
+	if m.Model != "" && m.Model != req.Model {
+		return false
+	}
+	if m.ResponseFormat != nil && *m.ResponseFormat != (len(req.ResponseFormat) > 0 && string(req.ResponseFormat) != "null") {
+		return false
+	}
+	if m.LastRole != "" && (len(req.Messages) == 0 || req.Messages[len(req.Messages)-1].Role != m.LastRole) {
+		return false
+	}
+	if m.Contains != "" {
+		lastUser := ""
+		for _, msg := range req.Messages {
+			if msg.Role == "user" {
+				lastUser = msg.text()
+			}
+		}
+		if !strings.Contains(lastUser, m.Contains) {
+			return false
+		}
+	}
+	return true
+}
@@ -33,11 +33,20 @@ function getSessionId() {
 const chatContainer = document.getElementById('chat-container');
 const messageInput = document.getElementById('message-input');
 const sendButton = document.getElementById('send-button');
+const stopButton = document.getElementById('stop-button');
 const themeToggle = document.getElementById('theme-toggle');
+const apiSelect = document.getElementById('api-select');
+const arenaSelect = document.getElementById('arena-select');
+const temperatureInput = document.getElementById('temperature-input');
+const topPInput = document.getElementById('top-p-input');
+const maxTokensInput = document.getElementById('max-tokens-input');
+const imageInput = document.getElementById('image-input');
+const attachButton = document.getElementById('attach-button');
 
 
 let currentResponseDiv = null;
 let isProcessingStream = false;
+let defaultApi = '';
 
 const initialInputHeight = messageInput.scrollHeight + 'px';
 messageInput.style.height = 'auto';
@@ -59,10 +68,20 @@ async function sendMessage() {
 	const prompt = messageInput.value.replace(/\r\n/g, '\n');
 	// const prompt = messageInput.value.trim();
 	if (!prompt || isProcessingStream) return;
+	if (arenaSelect.value) return sendArena(prompt);
 
 	const sessionId = getSessionId();
-	addMessage(prompt, 'user-message');
+	const images = Array.from(imageInput.files);
+	const userDiv = addMessage(prompt, 'user-message');
+	images.forEach((file) => {
+		const img = document.createElement('img');
+		img.classList.add('message-image');
+		img.src = URL.createObjectURL(file);
+		userDiv.appendChild(img);
+	});
 	messageInput.value = '';
+	imageInput.value = '';
+	updateAttachButton();
 
 	messageInput.style.height = 'auto';
 	messageInput.style.height = initialInputHeight;
@@ -70,6 +89,7 @@ async function sendMessage() {
 	isProcessingStream = true;
 	sendButton.disabled = true;
 	messageInput.disabled = true;
+	stopButton.classList.remove('hidden');
 
 	currentResponseDiv = document.createElement('div');
 	currentResponseDiv.classList.add('message', 'bot-message');
@@ -79,76 +99,432 @@ async function sendMessage() {
 	cursor.classList.add('cursor');
 	currentResponseDiv.appendChild(cursor);
 
-	const requestData = { prompt: prompt , sessionId: sessionId};
+	const requestData = { prompt: prompt , sessionId: sessionId, ...getSettings()};
 
 	try {
-		const response = await fetch(apiUrl, {
-			method: 'POST',
-			headers: { 'Content-Type': 'application/json' },
-			body: JSON.stringify(requestData),
-		});
+		let response = await fetch(apiUrl, buildRequest(requestData, images));
 
 		if (!response.ok) {
-			throw new Error(`API request failed: ${response.status}`);
+			const body = await response.json().catch(() => ({}));
+			throw new Error(body.error || `API request failed: ${response.status}`);
 		}
 
-		const reader = response.body.getReader();
-		const decoder = new TextDecoder();
-
 		let markdownContent = '';
+		let reasoningContent = '';
+		let reasoningDiv = null;
+		const toolDivs = {};
+		let lastEventId = null;
+
+		const renderAnswer = () => {
+			currentResponseDiv.innerHTML = marked.parse(markdownContent);
+			currentResponseDiv.appendChild(cursor);
+			currentResponseDiv.querySelectorAll('pre code').forEach((block) => {
+				hljs.highlightBlock(block);
+			});
+			chatContainer.scrollTop = chatContainer.scrollHeight;
+		};
+
+		// handleEvent renders one event, it returns true once the turn is done
+		const handleEvent = (event) => {
+			if (event.id) lastEventId = event.id;
+
+			switch (event.type) {
+			case 'token':
+				// Fold the reasoning away once the answer starts
+				if (reasoningDiv && !markdownContent) {
+					reasoningDiv.open = false;
+				}
+				markdownContent += event.data.text;
+				renderAnswer();
+				break;
+			case 'reasoning':
+				// Shown in a collapsible block above the answer
+				if (!reasoningDiv) {
+					reasoningDiv = createReasoningBlock();
+					chatContainer.insertBefore(reasoningDiv, currentResponseDiv);
+				}
+				reasoningContent += event.data.text;
+				reasoningDiv.querySelector('.reasoning-text').textContent = reasoningContent;
+				chatContainer.scrollTop = chatContainer.scrollHeight;
+				break;
+			case 'tool_call_start':
+				toolDivs[event.data.index] = createToolBlock(event.data.id, event.data.name);
+				chatContainer.insertBefore(toolDivs[event.data.index], currentResponseDiv);
+				break;
+			case 'tool_call_args':
+				if (toolDivs[event.data.index]) {
+					toolDivs[event.data.index].querySelector('.tool-args').textContent += event.data.delta;
+				}
+				break;
+			case 'tool_result': {
+				// Calls of the next tool turn reuse the indexes
+				const index = Object.keys(toolDivs).find((i) => toolDivs[i].dataset.id === event.data.id);
+				if (index !== undefined) {
+					toolDivs[index].querySelector('.tool-result').textContent = event.data.result;
+					delete toolDivs[index];
+				}
+				break;
+			}
+			case 'usage':
+				addUsage(event.data);
+				break;
+			case 'status':
+				// Shown until the answer starts, later ones are quoted below the text,
+				// e.g. before a re-prompted answer
+				if (!markdownContent) {
+					currentResponseDiv.textContent = event.data.message;
+					currentResponseDiv.appendChild(cursor);
+				} else {
+					markdownContent += `\n\n> ${event.data.message}\n\n`;
+					renderAnswer();
+				}
+				break;
+			case 'error':
+				throw new StreamError(event.data.message);
+			case 'done':
+				return true;
+			}
+			return false;
+		};
+
+		// The turn goes on on the server when the connection drops, so resume it
+		// from the last received event
+		for (let attempt = 1; ; attempt++) {
+			try {
+				if (await readEvents(response, handleEvent)) break;
+			} catch (error) {
+				if (error instanceof StreamError) throw error;
+				console.log('Stream interrupted:', error);
+			}
+			if (attempt > maxResumeAttempts) throw new Error('connection lost');
+			await new Promise((resolve) => setTimeout(resolve, 1000 * attempt));
 
-		readStream:
-		while (true) {
-			const { value, done } = await reader.read();
-			if (done) break;
-			const chunk = decoder.decode(value, { stream: true });
-			console.log('Raw chunk:', JSON.stringify(chunk));
-			const lines = chunk.split('\n\n').filter(Boolean);
+			const headers = lastEventId ? { 'Last-Event-ID': lastEventId } : {};
+			response = await fetch(`/generate/${sessionId}/stream`, { headers }).catch(() => null);
+			if (response && response.status === 404) throw new Error('the answer is no longer available');
+		}
 
-			for (const line of lines) {
-				if (line.startsWith('data: ')) {
-					const data = line.substring(6);
-					console.log('Received:', JSON.stringify(data));
+		if (cursor.parentNode === currentResponseDiv) {
+			currentResponseDiv.removeChild(cursor);
+		}
 
-					if (data === '[DONE]') {
-						break readStream;
-					}
+	} catch (error) {
+		currentResponseDiv.textContent = 'error: ' + error.message;
+	} finally {
+		isProcessingStream = false;
+		stopButton.classList.add('hidden');
+		sendButton.disabled = false;
+		messageInput.disabled = false;
+		messageInput.focus();
+		chatContainer.scrollTop = chatContainer.scrollHeight;
+	}
 
-					// Replace newline placeholders
-					const restoredData = data.replace(/\[NEWLINE\]/g, '\n');
-					markdownContent += restoredData;
 
-					// Parse Markdown
-					const htmlContent = marked.parse(markdownContent);
 
-					currentResponseDiv.innerHTML = htmlContent;
-					currentResponseDiv.appendChild(cursor);
+}
 
-					document.querySelectorAll('pre code').forEach((block) => {
-						hljs.highlightBlock(block);
-					});
+// Load selectable apis, the default entry keeps selectApi and its fallbacks
+async function loadApis() {
+	try {
+		const response = await fetch('/apis');
+		const data = await response.json();
+		const defaultOption = document.createElement('option');
+		defaultOption.value = '';
+		defaultOption.textContent = `default (${data.default})`;
+		apiSelect.appendChild(defaultOption);
+		defaultApi = data.default;
+		const noArena = document.createElement('option');
+		noArena.value = '';
+		noArena.textContent = 'no comparison';
+		arenaSelect.appendChild(noArena);
+		for (const api of data.apis) {
+			const option = document.createElement('option');
+			option.value = api;
+			option.textContent = api;
+			apiSelect.appendChild(option);
+			const arenaOption = option.cloneNode(true);
+			arenaOption.textContent = `vs ${api}`;
+			arenaSelect.appendChild(arenaOption);
+		}
+		await loadHealth();
+	} catch (error) {
+		console.log('load apis failed:', error);
+	}
+}
 
-					chatContainer.scrollTop = chatContainer.scrollHeight;
-				}
-			}
+// Disable the apis whose circuit is open, they refuse calls until they recover
+async function loadHealth() {
+	try {
+		const response = await fetch('/providers/health');
+		const data = await response.json();
+		const open = new Set(data.providers.filter((p) => p.state === 'open').map((p) => p.name));
+		for (const option of apiSelect.options) {
+			if (!option.value) continue;
+			option.disabled = open.has(option.value);
+			option.textContent = open.has(option.value) ? `${option.value} (unavailable)` : option.value;
+		}
+		for (const option of arenaSelect.options) {
+			if (!option.value) continue;
+			option.disabled = open.has(option.value);
+			option.textContent = open.has(option.value) ? `vs ${option.value} (unavailable)` : `vs ${option.value}`;
 		}
+	} catch (error) {
+		console.log('load health failed:', error);
+	}
+}
 
-		if (cursor.parentNode === currentResponseDiv) {
-			currentResponseDiv.removeChild(cursor);
+// sendArena answers the prompt with the selected api and the compared one side
+// by side, each in its own column, and then asks which answer was better
+async function sendArena(prompt) {
+	const apis = [apiSelect.value || defaultApi, arenaSelect.value];
+	if (apis[0] === apis[1]) {
+		addMessage('pick a different api to compare with', 'bot-message');
+		return;
+	}
+	const images = Array.from(imageInput.files);
+	const userDiv = addMessage(prompt, 'user-message');
+	images.forEach((file) => {
+		const img = document.createElement('img');
+		img.classList.add('message-image');
+		img.src = URL.createObjectURL(file);
+		userDiv.appendChild(img);
+	});
+	messageInput.value = '';
+	imageInput.value = '';
+	updateAttachButton();
+	messageInput.style.height = initialInputHeight;
+
+	isProcessingStream = true;
+	sendButton.disabled = true;
+	messageInput.disabled = true;
+	stopButton.classList.remove('hidden');
+
+	const row = document.createElement('div');
+	row.classList.add('arena-row');
+	chatContainer.appendChild(row);
+	const columns = {};
+	for (const api of apis) {
+		const column = document.createElement('div');
+		column.classList.add('arena-column');
+		const label = document.createElement('div');
+		label.classList.add('arena-model');
+		label.textContent = api;
+		const answer = document.createElement('div');
+		answer.classList.add('message', 'bot-message');
+		column.appendChild(label);
+		column.appendChild(answer);
+		row.appendChild(column);
+		columns[api] = { column, answer, text: '' };
+	}
+	let arenaId = null;
+
+	const settings = getSettings();
+	delete settings.api;
+	const requestData = { prompt: prompt, sessionId: getSessionId(), apis: apis, ...settings };
+
+	try {
+		const response = await fetch('/arena', buildRequest(requestData, images));
+		if (!response.ok) {
+			const body = await response.json().catch(() => ({}));
+			throw new Error(body.error || `API request failed: ${response.status}`);
 		}
 
+		// Events of each api carry its model, the untagged done ends the arena
+		const done = await readEvents(response, (event) => {
+			if (event.type === 'arena') {
+				arenaId = event.data.arenaId;
+				return false;
+			}
+			const col = columns[event.data.model];
+			if (!col) {
+				if (event.type === 'error') throw new Error(event.data.message);
+				return event.type === 'done';
+			}
+
+			switch (event.type) {
+			case 'token':
+				col.text += event.data.text;
+				col.answer.innerHTML = marked.parse(col.text);
+				col.answer.querySelectorAll('pre code').forEach((block) => {
+					hljs.highlightBlock(block);
+				});
+				break;
+			case 'status':
+				if (!col.text) col.answer.textContent = event.data.message;
+				break;
+			case 'usage': {
+				const usage = document.createElement('div');
+				usage.classList.add('usage-info');
+				usage.textContent = `${event.data.reqToken} in / ${event.data.resToken} out`;
+				col.column.appendChild(usage);
+				break;
+			}
+			case 'error':
+				col.answer.textContent = 'error: ' + event.data.message;
+				break;
+			}
+			chatContainer.scrollTop = chatContainer.scrollHeight;
+			return false;
+		});
+		if (!done) throw new Error('connection lost');
+		if (arenaId) addVoteBar(arenaId, apis);
+
 	} catch (error) {
-		currentResponseDiv.textContent = 'error: ' + error.message;
+		addMessage('error: ' + error.message, 'bot-message');
 	} finally {
 		isProcessingStream = false;
+		stopButton.classList.add('hidden');
 		sendButton.disabled = false;
 		messageInput.disabled = false;
 		messageInput.focus();
 		chatContainer.scrollTop = chatContainer.scrollHeight;
 	}
+}
+
+// addVoteBar asks which answer of the arena turn was better
+function addVoteBar(arenaId, apis) {
+	const bar = document.createElement('div');
+	bar.classList.add('arena-vote');
+	const choices = [...apis.map((api) => [api, `${api} is better`]), ['tie', 'Tie'], ['both_bad', 'Both bad']];
+	for (const [winner, text] of choices) {
+		const button = document.createElement('button');
+		button.textContent = text;
+		button.addEventListener('click', async () => {
+			try {
+				const response = await fetch(`/arena/${encodeURIComponent(arenaId)}/vote`, {
+					method: 'POST',
+					headers: { 'Content-Type': 'application/json' },
+					body: JSON.stringify({ winner: winner }),
+				});
+				const body = await response.json().catch(() => ({}));
+				bar.textContent = response.ok ? `Voted: ${text}` : `vote failed: ${body.error}`;
+			} catch (error) {
+				bar.textContent = 'vote failed: ' + error.message;
+			}
+		});
+		bar.appendChild(button);
+	}
+	chatContainer.appendChild(bar);
+}
+
+// maxResumeAttempts bounds the reconnects of a turn whose stream was interrupted
+const maxResumeAttempts = 5;
+
+// StreamError is an error event of the server, the turn failed and is not resumed
+class StreamError extends Error {}
+
+// readEvents passes the events of the response to handleEvent until it
+// reports the turn done (true), or the stream ends early (false)
+async function readEvents(response, handleEvent) {
+	if (!response || !response.ok) return false;
+
+	const reader = response.body.getReader();
+	const decoder = new TextDecoder();
+	let buffer = '';
+
+	while (true) {
+		const { value, done } = await reader.read();
+		if (done) return false;
+		buffer += decoder.decode(value, { stream: true });
+
+		// Events end with a blank line, an incomplete one waits for the next chunk
+		const frames = buffer.split('\n\n');
+		buffer = frames.pop();
+
+		for (const frame of frames) {
+			const event = parseEvent(frame);
+			if (event && handleEvent(event)) {
+				reader.cancel();
+				return true;
+			}
+		}
+	}
+}
+
+// parseEvent reads one "id: / event: / data:" frame of the stream, data is JSON
+function parseEvent(frame) {
+	const event = { id: null, type: 'message', data: null };
+	const data = [];
+	for (const line of frame.split('\n')) {
+		if (line.startsWith('id: ')) event.id = line.substring(4);
+		else if (line.startsWith('event: ')) event.type = line.substring(7);
+		else if (line.startsWith('data: ')) data.push(line.substring(6));
+	}
+	if (data.length === 0) return null;
+	event.data = JSON.parse(data.join('\n'));
+	return event;
+}
+
+function createToolBlock(id, name) {
+	const details = document.createElement('details');
+	details.classList.add('message', 'tool-message');
+	details.dataset.id = id;
+	const summary = document.createElement('summary');
+	summary.textContent = `Tool: ${name}`;
+	const args = document.createElement('pre');
+	args.classList.add('tool-args');
+	const result = document.createElement('pre');
+	result.classList.add('tool-result');
+	details.appendChild(summary);
+	details.appendChild(args);
+	details.appendChild(result);
+	return details;
+}
+
+function addUsage(usage) {
+	const div = document.createElement('div');
+	div.classList.add('usage-info');
+	let text = `${usage.provider} · ${usage.reqToken} in / ${usage.resToken} out`;
+	if (usage.reasoningToken) text += ` (${usage.reasoningToken} reasoning)`;
+	if (usage.estimated) text += ' · estimated';
+	div.textContent = text;
+	currentResponseDiv.after(div);
+}
+
+function createReasoningBlock() {
+	const details = document.createElement('details');
+	details.classList.add('message', 'reasoning-message');
+	details.open = true;
+	const summary = document.createElement('summary');
+	summary.textContent = 'Reasoning';
+	const text = document.createElement('div');
+	text.classList.add('reasoning-text');
+	details.appendChild(summary);
+	details.appendChild(text);
+	return details;
+}
 
+// Images are uploaded as multipart/form-data, plain prompts stay JSON
+function buildRequest(requestData, images) {
+	if (images.length === 0) {
+		return {
+			method: 'POST',
+			headers: { 'Content-Type': 'application/json' },
+			body: JSON.stringify(requestData),
+		};
+	}
+	const form = new FormData();
+	for (const [key, value] of Object.entries(requestData)) {
+		if (Array.isArray(value)) value.forEach((v) => form.append(key, v));
+		else form.append(key, value);
+	}
+	images.forEach((file) => form.append('images', file));
+	return { method: 'POST', body: form };
+}
 
+function updateAttachButton() {
+	const count = imageInput.files.length;
+	attachButton.textContent = count ? `Images (${count})` : 'Image';
+}
 
+// Collect the settings that were filled in, empty ones use server defaults
+function getSettings() {
+	const settings = {};
+	if (apiSelect.value) settings.api = apiSelect.value;
+	if (temperatureInput.value !== '') settings.temperature = parseFloat(temperatureInput.value);
+	if (topPInput.value !== '') settings.topP = parseFloat(topPInput.value);
+	if (maxTokensInput.value !== '') settings.maxTokens = parseInt(maxTokensInput.value, 10);
+	return settings;
 }
 
 function addMessage(text, className) {
@@ -168,6 +544,23 @@ function addMessage(text, className) {
 	return messageDiv;
 }
 
+// Ask the server to stop the running generation, the stream then ends by itself
+async function stopGeneration() {
+	if (!isProcessingStream) return;
+	try {
+		await fetch(`/generate/${getSessionId()}/cancel`, { method: 'POST' });
+	} catch (error) {
+		console.log('cancel failed:', error);
+	}
+}
+
+loadApis();
+
+stopButton.addEventListener('click', stopGeneration);
+apiSelect.addEventListener('focus', loadHealth);
+arenaSelect.addEventListener('focus', loadHealth);
+attachButton.addEventListener('click', () => imageInput.click());
+imageInput.addEventListener('change', updateAttachButton);
 sendButton.addEventListener('click', sendMessage);
 messageInput.addEventListener('keydown', (event) => {
 	if (event.key === 'Enter' && !event.shiftKey) {